@@ -35,6 +35,9 @@ var Version string
 
 const configdir = "/etc/qbox"
 
+// Logins (also via an alias) only work between `open` and `close`, 0 means no limit
+const login_window = "(`open` = 0 OR `open` <= UNIX_TIMESTAMP()) AND (`close` = 0 OR `close` > UNIX_TIMESTAMP())"
+
 //type authcachedata struct {
 //	uid	int64
 //	gid	int64
@@ -162,11 +165,12 @@ func authenticate(w http.ResponseWriter, r *http.Request) {
 		gid		int64
 		oathtoken	string
 		aliasof		string
+		locked		int64
 	}
 	var dbdata dbschema
 
 	// Prepare and execute query
-	stmt1, err := db.Prepare("SELECT password,homedir,sysuid,sysgid,quota,uid,gid,oath_token,alias_of FROM passwd WHERE username = ? AND ? != '' limit 1")
+	stmt1, err := db.Prepare("SELECT password,homedir,sysuid,sysgid,quota,uid,gid,oath_token,alias_of,locked FROM passwd WHERE username = ? AND ? != '' AND " + login_window + " limit 1")
 	if err != nil {
 		fmt.Println("Prepare SELECT FROM passwd failed: "+err.Error())
 	}
@@ -186,7 +190,8 @@ func authenticate(w http.ResponseWriter, r *http.Request) {
 				  &dbdata.uid,
 				  &dbdata.gid,
 				  &dbdata.oathtoken,
-			          &dbdata.aliasof)
+			          &dbdata.aliasof,
+				  &dbdata.locked)
 		if err != nil {
 			fmt.Println("Scaning SELECT FROM passwd result failed: "+err.Error())
 		}
@@ -201,13 +206,22 @@ func authenticate(w http.ResponseWriter, r *http.Request) {
 	// OTP
 	if (otp_verify(dbdata.oathtoken, reqdata.Password)) { authok = true }
 
+	// Locked accounts are checked after the password, so they can't be probed
+	if authok && dbdata.locked > 0 {
+		fmt.Fprintf(os.Stderr, "User %s is locked, denied on %s from %s\n", reqdata.Username, reqdata.Service, reqdata.Source)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
 	if authok {
 		// Write to log
 		fmt.Fprintf(os.Stderr, "Authentication succeeded for %s on %s from %s\n", reqdata.Username, reqdata.Service, reqdata.Source);
 
 		// Support aliasing
+		// The target account gets the same lifetime and locked checks as a direct login
 		if (dbdata.aliasof != "") {
-			stmt2, err := db.Prepare("SELECT password,homedir,sysuid,sysgid,quota,uid,gid,oath_token,alias_of FROM passwd WHERE username = ? limit 1")
+			aliasfound := false
+			stmt2, err := db.Prepare("SELECT password,homedir,sysuid,sysgid,quota,uid,gid,oath_token,alias_of,locked FROM passwd WHERE username = ? AND " + login_window + " limit 1")
 			if err != nil {
 				fmt.Println("Prepare SELECT FROM passwd failed for alias: "+err.Error())
 			}
@@ -226,13 +240,22 @@ func authenticate(w http.ResponseWriter, r *http.Request) {
 						  &dbdata.uid,
 						  &dbdata.gid,
 						  &dbdata.oathtoken,
-					          &dbdata.aliasof)
+					          &dbdata.aliasof,
+						  &dbdata.locked)
 
 				if err != nil {
 					fmt.Println("Scaning SELECT FROM passwd result failed for alias: "+err.Error())
+				} else {
+					aliasfound = true
 				}
 			}
 			rows2.Close()
+
+			if !aliasfound || dbdata.locked > 0 {
+				fmt.Fprintf(os.Stderr, "Alias target of %s is locked or not active, denied on %s from %s\n", reqdata.Username, reqdata.Service, reqdata.Source)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
 		}
 
 		// Send response to checkpassword-client
@@ -3,25 +3,44 @@ package main
 import "database/sql"
 import _ "github.com/go-sql-driver/mysql"
 import "context"
+import "archive/tar"
+import "archive/zip"
+import "bufio"
 import "bytes"
+import "compress/gzip"
+import "crypto/hmac"
+import "crypto/tls"
+import "encoding/base64"
 import "encoding/json"
 import "errors"
 import "fmt"
 import "io"
 import "log/syslog"
+import "mime"
+import "mime/quotedprintable"
 import "net"
+import "net/http"
+import "net/mail"
+import "net/smtp"
+import "net/textproto"
 import "os"
 import "os/exec"
 import "path"
 import "path/filepath"
 import "regexp"
+import "sort"
 import "strconv"
 import "strings"
 import "syscall"
 import "time"
 import "crypto/sha1"
 
+import "blitiri.com.ar/go/spf"
+import "github.com/emersion/go-msgauth/authres"
+import "github.com/emersion/go-msgauth/dkim"
+import "github.com/emersion/go-msgauth/dmarc"
 import "github.com/google/uuid"
+import "golang.org/x/net/publicsuffix"
 import "golang.org/x/sys/unix"
 import jwemail "github.com/jordan-wright/email"
 import "github.com/baruwa-enterprise/clamd"
@@ -33,23 +52,135 @@ const configdir = "/etc/qbox"
 
 var debug_enabled bool = false
 
+// Set by `--explain`, deliver then only shows what it would do
+var explain_enabled bool = false
+var explain_json bool = false
+var explained []explainstep
+
+type explainstep struct {
+	Step   string
+	Detail string
+}
+
 // Make DB available globally, not just in main
 var db *sql.DB
 
+// Returned by write_to_maildir if the quota would be exceeded
+var quota_exceeded = errors.New("Quota exceeded")
+
 type email struct {
 	Length    int
 	Recipient string
 	Sha1      string
-	Raw       string         // Message as read from STDIN (unaltered)
-	Object    *jwemail.Email // currently only used for Autoresponder
-	UseObject bool           // Use object instead of `Raw`, if true
+	Spool     string         // Message as read from STDIN (unaltered), spooled to disk
+	Header    mail.Header    // Headers of `Spool`, used for filter rules
+	Object    *jwemail.Email // Only set if the body changes, e.g. the quarantine notice
+	UseObject bool           // Use object instead of `Spool`, if true
 	IsSpam    bool
+	Delivered string       // First file written from `Object`, later maildirs link to it
+	Released  bool         // Released from quarantine, not scanned for viruses again
+	Prepend   string       // Header lines written before the message, e.g. Delivered-To
+	Spooled   string       // Lines already at the start of `Spool`, skipped by `open`
+	Edits     []headeredit // Applied to the header of `Spool` while writing
+}
+
+// A header change that leaves the body untouched, see `edited`
+type headeredit struct {
+	Name  string                  // Canonical header name
+	Value string                  // Added in front of the header, unless empty
+	Drop  func(value string) bool // Existing fields to remove, nil keeps all
+}
+
+// A recipient after mapping, see `resolve_recipient`
+type recipient struct {
+	Address      string
+	User         string // `*` if a wildcard mapping was used
+	Domain       string // After `rewrite_domain`
+	Extension    string
+	Destinations []destination
+}
+
+// Raised instead of os.Exit while delivering, so the LMTP server can
+// recover per recipient. In qmail mode, main exits with `Code`
+type delivery_exit struct {
+	Code    int
+	Message string
+}
+
+// Scan results of one message, shared by its recipients (LMTP),
+// so each scanner only runs once per message
+type scancache struct {
+	scanners []scanner
+	results  map[string]scanresult
+	auth     []authres.Result
+	policy   dmarc.Policy
+	authdone bool
+}
+
+type scanresult struct {
+	combined verdict
+	verdicts []verdict
+	err      error
 }
 
 func (m email) hasObject() bool {
 	return m.Object != nil
 }
 
+func (m email) open() (*os.File, error) {
+	// Readers get the message as received, without our own lines
+	file, err := os.Open(m.Spool)
+	if err == nil && m.Spooled != "" {
+		if _, err = file.Seek(int64(len(m.Spooled)), io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, err
+}
+
+func (m email) read() ([]byte, error) {
+	input, err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	return io.ReadAll(input)
+}
+
+func (m email) modified() bool {
+	// A spool that already holds `Prepend` can be linked as-is
+	return m.UseObject || m.Prepend != m.Spooled || len(m.Edits) > 0
+}
+
+func (m *email) set_header(name string, value string) {
+	// Replaces existing fields and earlier edits of the same header
+	name = textproto.CanonicalMIMEHeaderKey(name)
+	var edits []headeredit
+	for _, edit := range m.Edits {
+		if edit.Name != name {
+			edits = append(edits, edit)
+		}
+	}
+	m.Edits = append(edits, headeredit{Name: name, Value: value, Drop: func(string) bool { return true }})
+}
+
+func (m *email) add_header(name string, value string) {
+	m.Edits = append(m.Edits, headeredit{Name: textproto.CanonicalMIMEHeaderKey(name), Value: value})
+}
+
+func (m *email) drop_header(name string, drop func(value string) bool) {
+	m.Edits = append(m.Edits, headeredit{Name: textproto.CanonicalMIMEHeaderKey(name), Drop: drop})
+}
+
+func (m email) linksource() string {
+	// Unmodified messages can be linked from the spool file
+	if !m.modified() {
+		return m.Spool
+	}
+	return m.Delivered
+}
+
 type report struct {
 	Sender         string
 	Recipient      string
@@ -63,81 +194,286 @@ type report struct {
 	UseObject      bool
 	IsSpam         bool
 	OnDisk         int64
+	AuthResults    string          // Authentication-Results header, if enabled
+	Quarantine     string          // Release token, if the message was quarantined
+	Verdicts       []verdict       // Results of the individual scanners
+	ScanErrors     []string        // Scans that failed, see `scanfail_policy`
+	Outbound       []outbound      // Forwards and autoresponses
+	Skipped        []string        // Destinations completed by an earlier attempt
+	Loop           string          // Reason, if a mail loop was detected
+	RemovedParts   []removedpart   // Infected MIME parts, replaced by a placeholder
+	Attachments    []attachfinding // Matches of the attachment policy
+}
+
+// An infected MIME part, see `clean_message`
+type removedpart struct {
+	Part        string // Position in the MIME tree, like IMAP part numbers
+	ContentType string
+	Filename    string
+	Virus       string
+}
+
+// A rule from `attachpolicy`, the domain `*` applies to all domains
+// Kinds are `extension` (e.g. exe), `type` (declared or sniffed MIME type,
+// `application/x-*` matches a prefix), `double` (e.g. .pdf.exe), `macro`
+// (Office files with VBA) and `encrypted` (password-protected archives)
+// Actions are `block` (not delivered) and `quarantine`
+type attachrule struct {
+	Kind   string
+	Value  string
+	Action string
+}
+
+// A file found in the message, archive members are named `archive.zip/member`
+type attachment struct {
+	Part      string
+	Name      string
+	Declared  string // Content-Type of the MIME part
+	Sniffed   string // Detected from the content, see `sniff_type`
+	Macro     bool
+	Encrypted bool
+}
+
+type attachfinding struct {
+	Part   string
+	Name   string
+	Rule   string // kind:value
+	Action string
+}
+
+// Metadata stored next to each quarantined message
+type quarantined struct {
+	Token     string
+	Virus     string
+	Sender    string
+	Recipient string
+	Sha1      string
+	Size      int
+	Time      int64
+}
+
+// Content scanners are configured in `scanners`, one per line:
+// <type> <address> [timeout=<duration>] [weight=<float>] [password=<string>]
+// Types are `spamassassin`, `rspamd` (kind spam) and `clamav` (kind virus)
+type scanner interface {
+	name() string
+	kind() string
+	config() scannerconf
+	scan(message email, sender string, user string) (verdict, error)
+}
+
+type scannerconf struct {
+	Address  string
+	Timeout  time.Duration
+	Weight   float64
+	Password string
+}
+
+type spamassassin_scanner struct{ scannerconf }
+type rspamd_scanner struct{ scannerconf }
+type clamav_scanner struct{ scannerconf }
+
+func (s scannerconf) config() scannerconf { return s }
+
+func (spamassassin_scanner) name() string { return "SpamAssassin" }
+func (rspamd_scanner) name() string       { return "rspamd" }
+func (clamav_scanner) name() string       { return "ClamAV" }
+
+func (spamassassin_scanner) kind() string { return "spam" }
+func (rspamd_scanner) kind() string       { return "spam" }
+func (clamav_scanner) kind() string       { return "virus" }
+
+// Result of one scanner, or the combination of several
+type verdict struct {
+	Scanner  string
+	Spam     bool
+	Score    float64
+	Required float64    `json:",omitempty"` // The scanner's own spam threshold
+	Rules    []spamrule `json:",omitempty"` // Matched rules (SpamAssassin) or symbols (rspamd)
+	Virus    string     // Signature, if a virus was found
+	Error    string     `json:",omitempty"`
+}
+
+type spamrule struct {
+	Name        string
+	Score       float64
+	Description string `json:",omitempty"`
+}
+
+// Forwards and autoresponses are sent with the transport in `transport`:
+// qmail-inject [<path>]
+// sendmail [<path>]
+// smtp <host:port> [starttls=yes] [user=<name>] [password=<string>] [timeout=<duration>]
+// Without `transport`, /var/qmail/bin/qmail-inject is used
+type transport interface {
+	name() string
+	send(sender string, recipients []string, input io.Reader) (int, error)
+}
+
+type qmailinject_transport struct{ Path string }
+type sendmail_transport struct{ Path string }
+type smtp_transport struct {
+	Address  string
+	StartTLS bool
+	User     string
+	Password string
+	Timeout  time.Duration
+}
+
+func (qmailinject_transport) name() string { return "qmail-inject" }
+func (sendmail_transport) name() string    { return "sendmail" }
+func (t smtp_transport) name() string      { return "smtp:" + t.Address }
+
+// Result of one outbound message
+type outbound struct {
+	Kind      string // `forward` or `autoresponse`
+	Transport string
+	Recipient string
+	Result    int
+	Error     string `json:",omitempty"`
 }
 
 type destination struct {
-	Default string
-	Spam    string
+	Default    string
+	Spam       string
+	Uid        int
+	Username   string // passwd.username, passed to spamd for its user_prefs
+	Quota      int64  // in KB, 0 means unlimited
+	Extensions int    // see `extensions_*` below
+	Folder     string // Set for extension addresses (user+folder)
+	Filter     string // Set if a filter rule has matched
+	Locked     bool   // passwd.locked, see `locked_policy`
+
+	// Settings of the uid owning the destination, see `load_destinations`
+	Features      []string // Enabled features, e.g. `antispam`
+	Spamlimit     float64
+	Spamtag       string        // Put in front of the Subject of spam, e.g. [SPAM]
+	Spamresult    *verdict      `json:"-"` // The uid's own scan, for its X-Spam-* headers
+	Autoresponder autoresponder `json:"-"`
+
+	// Set per delivery
+	IsSpam     bool // The uid's spamlimit was reached
+	Quarantine bool // Gets the quarantine notice instead of the message
 }
 
-func main() {
-	// Start a timer
-	start := time.Now()
+// A filter rule joins `filter` (per uid) and `filters` (the expressions)
+// `Expression` is "<field> <operator>" where field is a header name or
+// SENDER / RECIPIENT for the envelope, operator is one of
+// `contains`, `is`, `begins`, `ends`, `matches` (regexp) or `exists`
+// `Destination` is a Maildir++ folder (.Folder), a forward, a pipe or /dev/null
+type filterrule struct {
+	Id          int
+	Applyto     int
+	Expression  string
+	Destination string
+	Value       string
+}
 
-	// Default exit code is 111
-	var exitcode int = 111
+// Autoresponder settings from `passwd`
+type autoresponder struct {
+	Start    int64 // arstart
+	End      int64 // arend
+	Interval int   // arinterval, seconds between two responses to a sender
+	Text     string
+}
 
-	// Set up a function to catch panic and exit with default code
-	defer func() {
-		if err := recover(); err != nil {
-			fmt.Println(err)
-			os.Exit(exitcode)
-		}
-	}()
+// Values for `passwd.extensions`
+const (
+	extensions_off    = 0 // Extension addresses are rejected
+	extensions_folder = 1 // Deliver to the folder, if it exists
+	extensions_create = 2 // Deliver to the folder, create it if necessary
+)
+
+// Values for `domains.scanfail` and `scanfail_policy`
+const (
+	scanfail_tag   = "tag"   // Deliver with a `failed` marker header
+	scanfail_defer = "defer" // Exit 111, so qmail retries later
+	scanfail_spam  = "spam"  // Deliver to the spam destination
+)
+
+// Values for `locked_policy`
+const (
+	locked_deliver = "deliver" // Deliver, only logins are refused
+	locked_defer   = "defer"   // Exit 111 until the account is unlocked
+	locked_bounce  = "bounce"  // Exit 100
+)
+
+// Mappings of accounts outside their `open`/`close` lifetime are ignored,
+// the address then falls back to the wildcard like an unmapped one
+const account_active = "(passwd.open = 0 OR passwd.open <= UNIX_TIMESTAMP()) AND (passwd.close = 0 OR passwd.close > UNIX_TIMESTAMP())"
+
+// Values for `filter.applyto`
+const (
+	applyto_all  = 0
+	applyto_ham  = 1
+	applyto_spam = 2
+)
 
+func main() {
 	if env_defined("QBOX_DEBUG") {
 		debug_enabled = true
 	}
 
-	// Generate a session ID to make log grep-ing easier
-	session := uuid.NewString()
-	syslog_write(fmt.Sprintf("%s / Starting session [version %s]", session, Version))
-
-	// Destinations is an array where email should go
-	// contains to strings: Default and Spam
-	var destinations []destination
+	// deliver --lmtp-listen unix:/path|host:port
+	if len(os.Args) > 1 && os.Args[1] == "--lmtp-listen" {
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: " + os.Args[0] + " --lmtp-listen unix:/path|host:port")
+			os.Exit(1)
+		}
+		open_database()
+		lmtp_listen(os.Args[2])
+		os.Exit(111)
+	}
 
-	// Record the delivery results
-	var deliveryresults []int
+	// deliver --explain RECIPIENT [--json] [< message]
+	if len(os.Args) > 1 && os.Args[1] == "--explain" {
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: " + os.Args[0] + " --explain RECIPIENT [--json]")
+			os.Exit(1)
+		}
+		explain_enabled = true
+		explain_json = len(os.Args) > 3 && os.Args[3] == "--json"
+		os.Setenv("RECIPIENT", os.Args[2])
+	}
 
-	var dreport report
-	dreport.Destinations = []destination{}
-	dreport.Features = []string{}
-	dreport.Results = []int{}
 	var message email
-	var err error
+	exitcode, reason := recover_delivery(func() int {
+		return deliver_qmail(&message)
+	})
 
-	// Read email message from STDIN
-	message.Raw, err = read_from_stdin()
-	if err != nil {
-		os.Exit(1)
+	// A dry run that stopped early still prints its steps, the result is
+	// part of them and not the exit code
+	if explain_enabled && reason != "" {
+		explain_finish(report{})
+		exitcode = 0
 	}
 
-	syslog_write(fmt.Sprintf("%s / Read %d bytes from STDIN", session, len(message.Raw)))
+	// Deliveries are hardlinks, so this only removes the spool's name
+	if message.Spool != "" {
+		os.Remove(message.Spool)
+	}
 
-	message.Length = len(message.Raw)
-	message.Recipient = strings.TrimPrefix(os.Getenv("RECIPIENT"), chomp(file_content(configdir+"/prefix")))
-	message.Sha1 = sha1sum(message.Raw)
+	os.Exit(exitcode)
+}
+
+// Delivers the message on STDIN to RECIPIENT, as run by qmail-local
+func deliver_qmail(message *email) int {
+	// Start a timer
+	start := time.Now()
+
+	// Generate a session ID to make log grep-ing easier
+	session := uuid.NewString()
+	syslog_write(fmt.Sprintf("%s / Starting session [version %s]", session, Version))
 
-	// NewEmailFromReader can fail (e.g. escaping issues)
-	// If it does, we can't use the object
-	// 2026-06-16: We now check the object before using it, so this check is no longer needed
-	message.Object, _ = jwemail.NewEmailFromReader(strings.NewReader(message.Raw))
+	message.Recipient = strings.TrimPrefix(os.Getenv("RECIPIENT"), chomp(file_content(configdir+"/prefix")))
 
 	if len(message.Recipient) == 0 {
 		fmt.Println("RECIPIENT not set!")
-		os.Exit(1)
+		return 1
 	}
 
 	syslog_write(fmt.Sprintf("%s / Recipient is <%s>", session, message.Recipient))
 
-	addrparts := strings.Split(message.Recipient, "@")
-	if len(addrparts) < 2 {
-		fmt.Println("ERROR: Could not split recipient address")
-		os.Exit(111)
-	}
-	user, domain := addrparts[0], addrparts[1]
-
 	// Read the `sender` from the environment
 	var sender string
 	if env_defined("SENDER") {
@@ -146,88 +482,257 @@ func main() {
 
 	syslog_write(fmt.Sprintf("%s / Sender is <%s>", session, sender))
 
-	// Read config files
-	var dbserver string = "127.0.0.1"
-	if file_exists(configdir + "/dbserver") {
-		dbserver = file_content(configdir + "/dbserver")
-	}
+	open_database()
+	defer db.Close()
 
-	var dbuser string = "qbox"
-	if file_exists(configdir + "/dbuser") {
-		dbuser = file_content(configdir + "/dbuser")
-	}
+	explain("recipient", message.Recipient)
+	explain("sender", "<"+sender+">")
 
-	var dbpass string
-	if file_exists(configdir + "/dbpass") {
-		dbpass = file_content(configdir + "/dbpass")
+	rcpt := resolve_recipient(session, message.Recipient)
+
+	// Spool email message from STDIN to disk, so memory usage does not
+	// depend on message size. The first maildir's `tmp` is used, so the
+	// spool file can be hardlinked into `new`
+	// The recipient is known, so Delivered-To is written while spooling
+	// When explaining, nothing is written to maildirs and the message is optional
+	var err error
+	if !explain_enabled {
+		message.Spooled = delivered_to(message.Recipient)
+		message.Spool, message.Length, message.Sha1, err = spool_message(spool_directory(rcpt.Destinations), message.Spooled, os.Stdin)
+	} else if stdin_is_message() {
+		message.Spool, message.Length, message.Sha1, err = spool_message(os.TempDir(), "", os.Stdin)
+	} else {
+		explain("message", "none on stdin, content checks are skipped")
+	}
+	if err != nil {
+		fmt.Println("ERROR: Could not spool message [" + err.Error() + "]")
+		return 1
 	}
 
-	// Initialize DB
-	db, err = sql.Open("mysql", dbuser+":"+dbpass+"@tcp("+dbserver+")/qbox")
-	if err == nil {
-		err = db.Ping()
-		if err != nil {
-			fmt.Println("ERROR: MySQL db.Ping failed! [" + err.Error() + "]")
-			os.Exit(exitcode)
+	syslog_write(fmt.Sprintf("%s / Read %d bytes from STDIN", session, message.Length))
+
+	// Headers are parsed separately, so filters work even if the object can't be parsed
+	message.Header = read_header(*message)
+
+	// Messages released from quarantine are not scanned again
+	if env_defined("QBOX_RELEASE") {
+		message.Released = is_released(os.Getenv("QBOX_RELEASE"), *message)
+		if message.Released {
+			syslog_write(fmt.Sprintf("%s / Message released from quarantine [%s]", session, os.Getenv("QBOX_RELEASE")))
 		}
-	} else {
-		fmt.Println("ERROR: Could not connect to MySQL [" + err.Error() + "]")
-		os.Exit(exitcode)
 	}
-	defer db.Close()
 
-	// Check for domain rewrite
-	debug("Calling rewrite_domain with parameter: " + domain + "\n")
-	domain = rewrite_domain(domain)
+	exitcode, dreport := process_message(session, start, *message, sender, rcpt, new_scancache())
+
+	if explain_enabled {
+		explain_finish(dreport)
+		return 0
+	}
+
+	return exitcode
+}
+
+// Maps an address to its destinations, exits with 100 or 111 if there are none
+func resolve_recipient(session string, address string) recipient {
+	addrparts := strings.Split(address, "@")
+	if len(addrparts) < 2 {
+		exit_delivery(111, "ERROR: Could not split recipient address")
+	}
+	user, domain := addrparts[0], addrparts[1]
 
 	// Remove extension
-	debug("Removing extension: " + user + " -> " + remove_extension(user) + "\n")
-	user = remove_extension(user)
+	var extension string
+	user, extension = split_extension(user, extension_delimiter())
+	debug("Removed extension: " + user + " -> " + extension + "\n")
 
-	// Get destinations
-	debug("Calling get_destinations with parameters: " + user + ", " + domain + "\n")
-	destinations = get_destinations(user, domain)
+	// Domain rewrite, mapping (with wildcard) and settings come in one query
+	debug("Calling load_destinations with parameters: " + user + ", " + domain + "\n")
+	rewritten, wildcard, destinations := load_destinations(user, domain)
 	if debug_enabled {
 		debug("Destinations: " + list_destinations(destinations) + "\n")
 	}
 
+	if rewritten != domain {
+		explain("rewrite", domain+" -> "+rewritten)
+	} else {
+		explain("rewrite", domain+" (unchanged)")
+	}
+	domain = rewritten
+	if extension != "" {
+		explain("extension", user+" with extension "+extension)
+	}
+
 	// Check wildcard
-	if len(destinations) == 0 {
-		debug("Checking for wildcards\n")
+	if wildcard {
+		explain("mapping", user+"@"+domain+" -> no uids")
+		explain("wildcard", "no destinations for "+user+"@"+domain+", trying *@"+domain)
 		user = `*`
-		destinations = get_destinations(user, domain)
 	}
+	explain("mapping", user+"@"+domain+" -> uids "+ints_to_list(destination_uids(destinations)))
 
 	// Check if we have at least one destination
 	if len(destinations) == 0 {
-		fmt.Println("Could not find mapping for " + message.Recipient)
-		os.Exit(100)
+		explain("result", "no mapping, message would be bounced (exit 100)")
+		exit_delivery(100, "Could not find mapping for "+address)
+	}
+
+	// Locked members of a group mapping are skipped, the others still get the message
+	if policy := locked_policy(); policy != locked_deliver {
+		var unlocked []destination
+		for _, dst := range destinations {
+			if dst.Locked {
+				syslog_write(fmt.Sprintf("%s / Skipping locked uid %d, policy is %s", session, dst.Uid, policy))
+				explain("locked", fmt.Sprintf("uid %d is locked, policy is %s", dst.Uid, policy))
+				continue
+			}
+			unlocked = append(unlocked, dst)
+		}
+		if len(unlocked) == 0 {
+			lockedexit := 100
+			if policy == locked_defer {
+				lockedexit = 111
+			}
+			explain("result", fmt.Sprintf("mailbox is locked (exit %d)", lockedexit))
+			exit_delivery(lockedexit, "Mailbox for "+address+" is locked")
+		}
+		destinations = unlocked
 	}
+	explain("destinations", list_destinations(destinations))
 
 	// At this point we have at least one destination for the message
 	syslog_write(fmt.Sprintf("%s / Destinations: %s", session, list_destinations(destinations)))
 
-	// Check if spam filter is active for this user
-	if feature_enabled(user, domain, "antispam") {
+	// Extension addresses (user+folder) go to a Maildir++ folder
+	if extension != "" {
+		if !extensions_allowed(destinations) {
+			explain("result", "extension addresses are disabled, message would be bounced (exit 100)")
+			exit_delivery(100, "Extension addresses are disabled for "+address)
+		}
+		for i, dst := range destinations {
+			destinations[i].Folder = extension_folder(dst, extension)
+			if destinations[i].Folder != "" {
+				debug("Extension " + extension + " maps to " + destinations[i].Folder + "\n")
+				explain("folder", fmt.Sprintf("uid %d: extension %s maps to %s", dst.Uid, extension, destinations[i].Folder))
+			}
+		}
+	}
+
+	return recipient{Address: address, User: user, Domain: domain, Extension: extension, Destinations: destinations}
+}
+
+// Runs the content checks for one recipient and delivers to its destinations
+// The spool is left in place, it may be shared with other recipients
+func process_message(session string, start time.Time, message email, sender string, rcpt recipient, cache *scancache) (int, report) {
+	domain := rcpt.Domain
+
+	// Filters are set per delivery, so the recipient's destinations are copied
+	destinations := append([]destination{}, rcpt.Destinations...)
+
+	// Default exit code is 111
+	var exitcode int = 111
+
+	// Record the delivery results
+	var deliveryresults []int
+
+	var dreport report
+	dreport.Destinations = []destination{}
+	dreport.Features = []string{}
+	dreport.Results = []int{}
+
+	// Loops are permanent, so there is no point in scanning the message
+	if reason := mail_loop(message); reason != "" {
+		if !explain_enabled {
+			fmt.Println("Mail loop detected for " + message.Recipient + " [" + reason + "]")
+		}
+		syslog_write(fmt.Sprintf("%s / Mail loop detected [%s]", session, reason))
+		explain("loop", reason+", message would be bounced (exit 100)")
+		dreport.Loop = reason
+		return finish_early(session, start, dreport, message, sender, 100)
+	}
+
+	// Every copy records where it was delivered, so loops can be detected
+	message.Prepend = delivered_to(message.Recipient)
+
+	if explain_enabled {
+		for _, dst := range destinations {
+			explain("features", fmt.Sprintf("uid %d: %s", dst.Uid, explain_features(dst)))
+			explain("spamlimit", fmt.Sprintf("uid %d: %.1f", dst.Uid, dst.Spamlimit))
+		}
+	}
+
+	// Verify DKIM, SPF and DMARC if an authserv-id is configured
+	if file_exists(configdir+"/authserv_id") && message.Spool != "" {
+		dreport.Features = append(dreport.Features, "authres")
+		authserv := chomp(file_content(configdir + "/authserv_id"))
+		debug("Running authentication checks\n")
+		results, policy := cache.authenticate(message, sender)
+		dreport.AuthResults = authres.Format(authserv, results)
+		explain("authres", dreport.AuthResults)
+		// Results claiming to be ours can't be trusted, so they are removed
+		message.drop_header("Authentication-Results", func(value string) bool {
+			return is_own_authresult(value, authserv)
+		})
+		message.add_header("Authentication-Results", dreport.AuthResults)
+		if policy == dmarc.PolicyReject {
+			for i, dst := range destinations {
+				if dst.feature("dmarcreject") {
+					syslog_write(fmt.Sprintf("%s / DMARC policy is reject, treating message as spam for uid %d", session, dst.Uid))
+					destinations[i].IsSpam = true
+				}
+			}
+		}
+	}
+
+	// Check if spam filter is active for any of the uids
+	if any_feature(destinations, "antispam") && message.Spool != "" {
 		dreport.Features = append(dreport.Features, "antispam")
-		debug("Running SPAM scan\n")
-		spamresult, spamerr := spamd_scan(&message.Raw)
-		if spamerr == nil {
-			if message.hasObject() {
-				message.Object.Headers.Set("X-Spam-Flag", bool_yesno(spamresult.IsSpam))
-				message.Object.Headers.Set("X-Spam-Level", strings.Repeat(`*`, not_negative(int(spamresult.Score))))
-				message.UseObject = true
+
+		// Each uid is scanned with its own preferences, uids without `antispam` get the message as-is
+		scanned := make(map[string]bool)
+		failed := false
+		var scanfail string
+		for i, dst := range destinations {
+			if !dst.feature("antispam") {
+				continue
+			}
+			debug("Running SPAM scan for " + dst.Username + "\n")
+			spamresult, spamverdicts, spamerr := cache.scan("spam", dst.Username, message, sender)
+			if !scanned[dst.Username] {
+				scanned[dst.Username] = true
+				dreport.Verdicts = append(dreport.Verdicts, spamverdicts...)
+				explain_verdicts(spamverdicts)
+			}
+
+			if spamerr != nil {
+				if !failed {
+					scanfail = scanfail_policy(domain)
+					syslog_write(fmt.Sprintf("%s / Spam scan failed, policy is %s [%s]", session, scanfail, spamerr.Error()))
+					dreport.ScanErrors = append(dreport.ScanErrors, spamerr.Error())
+					if apply_scanfail(scanfail, &message, "X-Spam-Scanned") {
+						defer_scanfail(session, start, dreport, message, sender)
+					}
+					failed = true
+				}
+				// Only the uids whose scan failed are treated as spam
+				if scanfail == scanfail_spam {
+					destinations[i].IsSpam = true
+				}
+				continue
 			}
-			if spamresult.Score >= user_spamlimit(user, domain) {
-				debug(fmt.Sprintf("Spamlimit %f is reached or exceeded by %f\n", user_spamlimit(user, domain), spamresult.Score))
-				message.IsSpam = true
+
+			// The headers are set per delivery, see `uid_headers`
+			result := header_verdict(spamresult, spamverdicts)
+			destinations[i].Spamresult = &result
+			explain("spam", fmt.Sprintf("uid %d (%s): score %.1f, limit %.1f, tests %s", dst.Uid, dst.Username, spamresult.Score, dst.Spamlimit, spam_tests(spamresult)))
+			if spamresult.Score >= dst.Spamlimit {
+				debug(fmt.Sprintf("Spamlimit %f of uid %d is reached or exceeded by %f\n", dst.Spamlimit, dst.Uid, spamresult.Score))
+				destinations[i].IsSpam = true
 			}
 		}
 	}
 
 	// Check for existing Spam markers
-	if message.hasObject() {
-		subjectline := message.Object.Subject
+	for _, subjectline := range header_values(message, "Subject") {
 		// This is used by SpamBarrier
 		spamre1 := regexp.MustCompile(`\*\*\*\*\*SPAM\*\*\*\*\*`)
 		spamre2 := regexp.MustCompile(`\[SPAM\]`)
@@ -237,122 +742,299 @@ func main() {
 		}
 	}
 
-	// Check if virus filter is active for this user
-	if feature_enabled(user, domain, "antivir") {
+	// Check if virus filter is active for any of the uids
+	var notice email
+	if any_feature(destinations, "antivir") && !message.Released && message.Spool != "" {
 		dreport.Features = append(dreport.Features, "antivir")
 		debug("Running AV scan\n")
-		avresult, averr := clamd_scan(&message.Raw)
+		avresult, avverdicts, averr := cache.scan("virus", "", message, sender)
+		dreport.Verdicts = append(dreport.Verdicts, avverdicts...)
+		explain_verdicts(avverdicts)
 		if averr == nil {
-			debug("AV result: " + avresult.Status + "\n")
-			if message.hasObject() {
-				message.Object.Headers.Set("X-Virus-Scanned", "ClamAV")
-				message.UseObject = true
-			}
-			if avresult.Status != "OK" {
-				if message.hasObject() {
-					// Virus was found, strip attachments
-					message.Object.Attachments = nil
-					// Add a security note instead
-					message.Object.Attach(strings.NewReader("Attachments have been removed by virus scanner"), "security_notice.txt", "text/plain")
+			debug("AV result: " + avresult.Virus + "\n")
+			message.set_header("X-Virus-Scanned", avresult.Scanner)
+			if avresult.Virus != "" && explain_enabled {
+				explain("quarantine", "virus "+avresult.Virus+" found, message would be quarantined")
+			} else if avresult.Virus != "" {
+				// Virus was found, keep the original and deliver a notice instead
+				token, qerr := quarantine_message(message, sender, avresult.Virus)
+				if qerr != nil {
+					exit_delivery(111, "ERROR: Could not quarantine message ["+qerr.Error()+"]")
+				}
+				dreport.Quarantine = token
+
+				// If the virus is in some of the parts, only those are removed
+				cleaned, removed, cerr := clean_message(message, sender, token)
+				if cerr != nil {
+					debug("Could not scan MIME parts [" + cerr.Error() + "]\n")
+				}
+				if cerr == nil && len(removed) > 0 {
+					syslog_write(fmt.Sprintf("%s / Virus %s found, %d part(s) removed, message quarantined [%s]", session, avresult.Virus, len(removed), token))
+					dreport.RemovedParts = removed
+					defer os.Remove(cleaned)
+					// Header edits still apply, the cleaned copy has the same header
+					notice = message
+					notice.Spool = cleaned
+					notice.Spooled = ""
+					notice.Length = int(filesize(cleaned))
 				} else {
-					syslog_write(fmt.Sprintf("%s / Virus found, but message could not be parsed; leaving message unmodified", session))
+					syslog_write(fmt.Sprintf("%s / Virus %s found, message quarantined [%s]", session, avresult.Virus, token))
+					// The notice is a new message, the header edits belong to the original
+					notice = message
+					notice.Edits = nil
+					notice.Object = quarantine_notice(message, sender, "virus "+avresult.Virus, token)
+					notice.Object.Headers.Set("X-Virus-Scanned", avresult.Scanner)
+					notice.UseObject = true
+				}
+				for i, dst := range destinations {
+					destinations[i].Quarantine = dst.feature("antivir")
+				}
+			}
+		} else {
+			policy := scanfail_policy(domain)
+			syslog_write(fmt.Sprintf("%s / Virus scan failed, policy is %s [%s]", session, policy, averr.Error()))
+			dreport.ScanErrors = append(dreport.ScanErrors, averr.Error())
+			if apply_scanfail(policy, &message, "X-Virus-Scanned") {
+				defer_scanfail(session, start, dreport, message, sender)
+			}
+			for i, dst := range destinations {
+				if policy == scanfail_spam && dst.feature("antivir") {
+					destinations[i].IsSpam = true
+				}
+			}
+		}
+	}
+
+	// Check the attachment policy for uids with `attachfilter`
+	if any_feature(destinations, "attachfilter") && !message.Released && message.Spool != "" {
+		dreport.Features = append(dreport.Features, "attachfilter")
+		debug("Running attachment check\n")
+		findings, err := attachment_check(message, get_attachrules(domain))
+		if err != nil {
+			// Handled like a failed virus scan, so large messages don't bypass the policy
+			policy := scanfail_policy(domain)
+			syslog_write(fmt.Sprintf("%s / Attachment check failed, policy is %s [%s]", session, policy, err.Error()))
+			dreport.ScanErrors = append(dreport.ScanErrors, "attachments: "+err.Error())
+			if apply_scanfail(policy, &message, "X-Attachments-Scanned") {
+				defer_scanfail(session, start, dreport, message, sender)
+			}
+			for i, dst := range destinations {
+				if policy == scanfail_spam && dst.feature("attachfilter") {
+					destinations[i].IsSpam = true
+				}
+			}
+		}
+		dreport.Attachments = findings
+		for _, finding := range findings {
+			explain("attachment", fmt.Sprintf("%s (part %s) matches %s, action %s", finding.Name, finding.Part, finding.Rule, finding.Action))
+		}
+
+		if action, reason := attachment_action(findings); action == "block" {
+			syslog_write(fmt.Sprintf("%s / Attachment policy blocks the message [%s]", session, reason))
+			var allowed []destination
+			for _, dst := range destinations {
+				if !dst.feature("attachfilter") {
+					allowed = append(allowed, dst)
+				}
+			}
+			if len(allowed) == 0 {
+				if !explain_enabled {
+					fmt.Println("Message rejected by attachment policy for " + message.Recipient + " [" + reason + "]")
 				}
+				explain("result", "blocked by attachment policy, message would be bounced (exit 100)")
+				return finish_early(session, start, dreport, message, sender, 100)
+			}
+			destinations = allowed
+		} else if action == "quarantine" && explain_enabled {
+			explain("quarantine", "attachment policy ("+reason+"), message would be quarantined")
+		} else if action == "quarantine" && dreport.Quarantine == "" {
+			token, qerr := quarantine_message(message, sender, "policy "+reason)
+			if qerr != nil {
+				exit_delivery(111, "ERROR: Could not quarantine message ["+qerr.Error()+"]")
+			}
+			syslog_write(fmt.Sprintf("%s / Attachment policy quarantined the message [%s] [%s]", session, reason, token))
+			dreport.Quarantine = token
+			notice = message
+			notice.Edits = nil
+			notice.Object = quarantine_notice(message, sender, "attachment "+reason, token)
+			notice.UseObject = true
+			for i, dst := range destinations {
+				destinations[i].Quarantine = dst.feature("attachfilter")
+			}
+		} else if action == "quarantine" {
+			// Already quarantined for a virus, uids with `attachfilter` get that notice too
+			for i, dst := range destinations {
+				destinations[i].Quarantine = dst.Quarantine || dst.feature("attachfilter")
 			}
 		}
 	}
 
+	// Apply the server-side filter rules of each uid
+	for i, dst := range destinations {
+		if dst.Uid > 0 && destination_type(dst.Default) == "maildir" {
+			destinations[i].Filter = apply_filters(dst, message, sender, message.IsSpam || dst.IsSpam)
+			if destinations[i].Filter != "" {
+				syslog_write(fmt.Sprintf("%s / Filter rule matched for uid %d: %s", session, dst.Uid, destinations[i].Filter))
+				explain("filter", fmt.Sprintf("uid %d: rule matched, destination %s", dst.Uid, destinations[i].Filter))
+			}
+		}
+	}
+
+	// Only multiple destinations can partially fail, see below
+	journaled := len(destinations) > 1 && message.Spool != ""
+	completed := make(map[string]bool)
+	if journaled {
+		completed = journal_completed(message)
+	}
+
+	copies := make(map[string]string)
 	for _, dst := range destinations {
+		// uids with `antivir` get the notice, the others the original
+		delivery := message
+		if dst.Quarantine {
+			delivery = notice
+		}
+
+		// Spam headers and the Subject tag differ per uid, only copies
+		// with the same headers can be hardlinked
+		copykey := fmt.Sprintf("%t\x00%s", dst.Quarantine, uid_headers(&delivery, dst))
+		delivery.Delivered = copies[copykey]
+
 		var destination string
 		destination = dst.Default
-		if message.IsSpam {
+		if dst.Folder != "" {
+			destination = dst.Folder
+		}
+		if message.IsSpam || dst.IsSpam {
 			destination = dst.Spam
 		}
+		if dst.Filter != "" {
+			destination = dst.Filter
+		}
+
+		// A retry after a partial failure skips what already succeeded
+		if completed[journal_key(dst)] {
+			syslog_write(fmt.Sprintf("%s / Skipping %s, completed by an earlier attempt", session, destination))
+			explain("action", destination+", completed by an earlier attempt")
+			dreport.Skipped = append(dreport.Skipped, destination)
+			deliveryresults = append(deliveryresults, 0)
+			continue
+		}
+
+		if explain_enabled {
+			explain("action", explain_action(dst, destination, delivery, sender, dst.feature("dupfilter")))
+			continue
+		}
 
 		debug("Starting delivery to " + destination + "\n")
 		syslog_write(fmt.Sprintf("%s / Delivering to %s", session, destination))
 		switch destination_type(destination) {
 		case "maildir":
-			if !is_valid_maildir(destination) {
+			if !strings.HasPrefix(destination, "/dev/null") && !is_valid_maildir(destination) {
 				fmt.Printf("ERROR: %s is not a valid maildir\n", destination)
 				deliveryresults = append(deliveryresults, 1)
 				break
 			}
 
-			dupfilter := feature_enabled(user, domain, "dupfilter")
+			dupfilter := dst.feature("dupfilter")
 			if dupfilter {
 				dreport.Features = append(dreport.Features, "dupfilter")
 			}
-			if dupfilter && is_duplicate(destination, message.Sha1) {
-				fmt.Println("Message to " + destination + " for " + message.Recipient + " was a duplicate (" + message.Sha1 + ")")
+			if dupfilter && is_duplicate(destination, delivery) {
+				fmt.Println("Message to " + destination + " for " + delivery.Recipient + " was a duplicate (" + delivery.Sha1 + ")")
 				deliveryresults = append(deliveryresults, 0)
 			} else {
-				writesuccess, err, ondisk := write_to_maildir(message, destination)
+				writesuccess, err, ondisk := write_to_maildir(&delivery, destination, dst.Quota)
 				dreport.OnDisk = ondisk
 				if writesuccess {
-					fmt.Println("Message delivered to " + destination + " for " + message.Recipient)
+					fmt.Println("Message delivered to " + destination + " for " + delivery.Recipient)
 					deliveryresults = append(deliveryresults, 0)
+					if dupfilter && !strings.HasPrefix(destination, "/dev/null") {
+						if err := record_duplicate(destination, delivery); err != nil {
+							syslog_write(fmt.Sprintf("%s / Could not update duplicate index for %s [%s]", session, destination, err.Error()))
+						}
+					}
+				} else if err == quota_exceeded {
+					fmt.Println("ERROR: Mailbox " + destination + " for " + delivery.Recipient + " is over quota")
+					deliveryresults = append(deliveryresults, quota_exitcode())
 				} else {
-					fmt.Println("ERROR: Could not deliver to " + destination + " for " + message.Recipient + " [" + err.Error() + "]")
+					fmt.Println("ERROR: Could not deliver to " + destination + " for " + delivery.Recipient + " [" + err.Error() + "]")
 					deliveryresults = append(deliveryresults, 1)
 				}
 			}
 
 		case "forward":
-			_, fwdsuccess, err := sysexec("/var/qmail/bin/qmail-inject", []string{"-f" + forward_sender(), destination}, []byte(message.Raw))
+			fwdsuccess, err := forward_message(destination, forward_envelope(sender), delivery)
+			dreport.Outbound = append(dreport.Outbound, new_outbound("forward", destination, fwdsuccess, err))
 			if fwdsuccess == 0 {
-				fmt.Println("Message forwarded to " + destination + " for " + message.Recipient)
+				fmt.Println("Message forwarded to " + destination + " for " + delivery.Recipient)
 			} else {
-				fmt.Println("ERROR: Could not forward to " + destination + " for " + message.Recipient + " [" + err.Error() + "]")
+				fmt.Println("ERROR: Could not forward to " + destination + " for " + delivery.Recipient + " [" + err.Error() + "]")
 			}
 			deliveryresults = append(deliveryresults, fwdsuccess)
 
 		case "pipe":
 			destination = strings.TrimPrefix(destination, `|`)
-			_, execsuccess, err := sysexec(destination, nil, []byte(message.Raw))
+			_, execsuccess, err := sysexec_message(destination, nil, delivery)
 			if execsuccess == 0 {
-				fmt.Println("Message piped to " + destination + " for " + message.Recipient)
+				fmt.Println("Message piped to " + destination + " for " + delivery.Recipient)
 			} else {
-				fmt.Println("ERROR: Pipe failed to " + destination + " for " + message.Recipient + " [" + err.Error() + "]")
+				fmt.Println("ERROR: Pipe failed to " + destination + " for " + delivery.Recipient + " [" + err.Error() + "]")
 			}
 			deliveryresults = append(deliveryresults, execsuccess)
 
+		case "lmtp":
+			lmtpresult, err := lmtp_deliver(destination, sender, lmtp_recipient(dst, delivery), delivery)
+			if lmtpresult == 0 {
+				fmt.Println("Message delivered via " + destination + " for " + delivery.Recipient)
+			} else {
+				fmt.Println("ERROR: LMTP delivery to " + destination + " failed for " + delivery.Recipient + " [" + err.Error() + "]")
+			}
+			deliveryresults = append(deliveryresults, lmtpresult)
+
 		case "":
-			fmt.Println("Homedir is not defined for " + message.Recipient)
+			fmt.Println("Homedir is not defined for " + delivery.Recipient)
 			deliveryresults = append(deliveryresults, 111)
 
 		default:
-			fmt.Println("Can not handle " + destination + " for " + message.Recipient)
+			fmt.Println("Can not handle " + destination + " for " + delivery.Recipient)
 			deliveryresults = append(deliveryresults, 111)
 		}
+
+		if journaled && deliveryresults[len(deliveryresults)-1] == 0 {
+			if err := record_journal(message, journal_key(dst)); err != nil {
+				syslog_write(fmt.Sprintf("%s / Could not update delivery journal for %s [%s]", session, destination, err.Error()))
+			}
+		}
+
+		// Later maildirs hardlink the first written copy
+		copies[copykey] = delivery.Delivered
 	}
 
 	// Autoresponder code goes here
-	// Mailing lists are ignored (if List-ID header is present)
-	// If there is no X-Mailer Header, it's likely automated, so no response either
-	noreply := regexp.MustCompile(`^noreply`)
-	if feature_enabled(user, domain, "autoresponder") &&
-		!noreply.MatchString(sender) &&
-		sender != "" &&
-		message.hasObject() &&
-		message.Object.Headers.Get("List-ID") == "" &&
-		message.Object.Headers.Get("X-Mailer") != "" {
-		if !autoresponder_history(user, domain, sender, 604800) {
-			ar := jwemail.NewEmail()
-			ar.From = "<" + message.Recipient + ">"
-			ar.To = []string{"<" + sender + ">"}
-			if message.Object.Headers.Get("Subject") == "" {
-				ar.Subject = "Autoresponder reply\n"
+	// Responses follow RFC 3834: automated mail (mailing lists, bulk mail,
+	// other autoresponders, bounces) never gets a reply
+	for _, dst := range destinations {
+		if !dst.feature("autoresponder") ||
+			message.IsSpam || dst.IsSpam ||
+			is_automated(message, sender) {
+			continue
+		}
+		settings := dst.Autoresponder
+		if settings.active(time.Now().Unix()) &&
+			!autoresponder_history(dst.Uid, sender, settings.Interval) {
+			if explain_enabled {
+				explain("autoresponder", fmt.Sprintf("uid %d: a response would be sent to <%s>", dst.Uid, sender))
 			} else {
-				ar.Subject = "Auto: " + message.Object.Headers.Get("Subject")
-			}
-			ar.Text = []byte(autoresponder_text(user, domain))
-
-			arbytes, _ := ar.Bytes()
-			_, arsuccess, _ := sysexec("/var/qmail/bin/qmail-inject",
-				[]string{"-f" + message.Recipient, sender},
-				arbytes)
-			if arsuccess == 0 {
-				record_autoresponse(email_to_uid(user, domain), sender)
+				arbytes, _ := autoresponder_reply(message, sender, settings.Text).Bytes()
+				// The null envelope sender prevents bounces (and loops) to the response
+				arsuccess, err := get_transport().send("", []string{sender}, bytes.NewReader(arbytes))
+				dreport.Outbound = append(dreport.Outbound, new_outbound("autoresponse", sender, arsuccess, err))
+				if arsuccess == 0 {
+					record_autoresponse(dst.Uid, sender)
+				} else {
+					syslog_write(fmt.Sprintf("%s / Autoresponse to <%s> failed [%s]", session, sender, err.Error()))
+				}
 			}
 		}
 	}
@@ -362,7 +1044,7 @@ func main() {
 		exitcode = deliveryresults[0]
 	} else {
 		// For multiple deliveries, if one fails, we exit 111 to get another chance
-		// Yes, that may cause duplicates, but that's better than losing mail
+		// The delivery journal keeps the retry from duplicating the others
 		if array_sum(deliveryresults) > 0 {
 			exitcode = 111
 		} else {
@@ -370,8 +1052,13 @@ func main() {
 		}
 	}
 
+	// Nothing will be retried, so the journal entries are no longer needed
+	if journaled && exitcode == 0 && !explain_enabled {
+		clear_journal(message)
+	}
+
 	// Delivery Report
-	dreport.Sender = os.Getenv("SENDER")
+	dreport.Sender = sender
 	dreport.Recipient = message.Recipient
 	dreport.Size = message.Length
 	dreport.Destinations = destinations
@@ -381,7 +1068,26 @@ func main() {
 	dreport.UseObject = message.UseObject
 	dreport.ObjectOK = message.hasObject()
 	dreport.IsSpam = message.IsSpam
+	for _, dst := range destinations {
+		dreport.IsSpam = dreport.IsSpam || dst.IsSpam
+	}
 
+	log_report(session, dreport)
+	return exitcode, dreport
+}
+
+func finish_early(session string, start time.Time, dreport report, message email, sender string, exitcode int) (int, report) {
+	// Nothing was delivered, so the report only has the basics
+	dreport.Sender = sender
+	dreport.Recipient = message.Recipient
+	dreport.Size = message.Length
+	dreport.Exitcode = exitcode
+	dreport.ProcessingTime = time.Duration(time.Since(start)).Seconds()
+	log_report(session, dreport)
+	return exitcode, dreport
+}
+
+func log_report(session string, dreport report) {
 	// Put delivery report into JSON
 	json, _ := json.Marshal(dreport)
 	if debug_enabled {
@@ -389,21 +1095,159 @@ func main() {
 	}
 
 	syslog_write(fmt.Sprintf("%s / Report: %s", session, string(json)))
-	syslog_write(fmt.Sprintf("%s / Finishing with code %d", session, exitcode))
+	syslog_write(fmt.Sprintf("%s / Finishing with code %d", session, dreport.Exitcode))
+}
 
-	os.Exit(exitcode)
+func mail_loop(message email) string {
+	for _, delivered := range message.Header["Delivered-To"] {
+		if strings.EqualFold(strings.TrimSpace(delivered), message.Recipient) {
+			return "already delivered to " + message.Recipient
+		}
+	}
+
+	if hops := len(message.Header["Received"]); hops > max_hops() {
+		return fmt.Sprintf("%d Received headers, limit is %d", hops, max_hops())
+	}
+	return ""
+}
+
+func max_hops() int {
+	// Same default as qmail's MAXHOPS
+	hops, err := strconv.Atoi(chomp(file_content(configdir + "/max_hops")))
+	if err != nil || hops <= 0 {
+		return 100
+	}
+	return hops
+}
+
+func exit_delivery(code int, message string) {
+	print_result(message)
+	panic(delivery_exit{Code: code, Message: message})
+}
+
+func recover_delivery(deliver func() int) (exitcode int, message string) {
+	// Anything but `exit_delivery` is unexpected and handled like a temporary failure
+	defer func() {
+		if err := recover(); err != nil {
+			if exit, ok := err.(delivery_exit); ok {
+				exitcode, message = exit.Code, exit.Message
+				return
+			}
+			exitcode, message = 111, fmt.Sprint(err)
+			print_result(message)
+		}
+	}()
+
+	return deliver(), ""
+}
+
+func print_result(message string) {
+	// qmail-local puts STDOUT into the bounce, when explaining it would
+	// end up in the middle of the output
+	if explain_enabled {
+		explain("exit", message)
+		return
+	}
+	fmt.Println(message)
+}
+
+func open_database() {
+	// Read config files
+	var dbserver string = "127.0.0.1"
+	if file_exists(configdir + "/dbserver") {
+		dbserver = file_content(configdir + "/dbserver")
+	}
+
+	var dbuser string = "qbox"
+	if file_exists(configdir + "/dbuser") {
+		dbuser = file_content(configdir + "/dbuser")
+	}
+
+	var dbpass string
+	if file_exists(configdir + "/dbpass") {
+		dbpass = file_content(configdir + "/dbpass")
+	}
+
+	// Initialize DB
+	var err error
+	db, err = sql.Open("mysql", dbuser+":"+dbpass+"@tcp("+dbserver+")/qbox")
+	if err == nil {
+		err = db.Ping()
+		if err != nil {
+			fmt.Println("ERROR: MySQL db.Ping failed! [" + err.Error() + "]")
+			os.Exit(111)
+		}
+	} else {
+		fmt.Println("ERROR: Could not connect to MySQL [" + err.Error() + "]")
+		os.Exit(111)
+	}
+
+	// The LMTP server keeps running, so idle connections are recycled
+	db.SetConnMaxIdleTime(time.Minute)
+	db.SetMaxIdleConns(4)
 }
 
-func read_from_stdin() (string, error) {
-	var message []byte
-	message, err := io.ReadAll(os.Stdin)
-	return string(message), err
+func delivered_to(recipient string) string {
+	return "Delivered-To: " + recipient + "\n"
 }
 
-func sha1sum(message string) string {
+func spool_message(directory string, prefix string, input io.Reader) (string, int, string, error) {
+	// The spool file follows maildir naming in `tmp`, so if deliver dies
+	// before removing it, it is cleaned up like any other stale file
+	filename := directory + "/" + epoch() + "." + strconv.Itoa(os.Getpid()) + "." + sys_hostname() + ".spool"
+	debug("Spooling message to " + filename + "\n")
+	spool, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	// The hash and length are calculated while reading, `prefix` is not part of them
 	hash := sha1.New()
-	_, _ = io.WriteString(hash, message)
-	return fmt.Sprintf("%x", hash.Sum(nil))
+	_, err = spool.WriteString(prefix)
+	var length int64
+	if err == nil {
+		length, err = io.Copy(io.MultiWriter(spool, hash), input)
+	}
+	if err != nil {
+		spool.Close()
+		os.Remove(filename)
+		return "", 0, "", err
+	}
+
+	err = spool.Close()
+	if err != nil {
+		os.Remove(filename)
+		return "", 0, "", err
+	}
+
+	return filename, int(length), fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+func spool_directory(destinations []destination) string {
+	for _, dst := range destinations {
+		if destination_type(dst.Default) == "maildir" && is_valid_maildir(dst.Default) {
+			return dst.Default + "/tmp"
+		}
+	}
+
+	// No maildir (e.g. forward or pipe only)
+	return os.TempDir()
+}
+
+func read_header(message email) mail.Header {
+	spool, err := message.open()
+	if err != nil {
+		return nil
+	}
+	defer spool.Close()
+
+	// ReadMessage stops after the header, the body is not read
+	parsed, err := mail.ReadMessage(bufio.NewReader(spool))
+	if err != nil {
+		return nil
+	}
+
+	return parsed.Header
 }
 
 func epoch() string {
@@ -429,133 +1273,199 @@ func write_to_file(message email, filename string) (bool, error) {
 		return false, errors.New("Not an absolute path")
 	}
 
-	debug("Writing to " + filename + "\n")
-	var werr error
-	if message.UseObject && message.hasObject() {
-		// This has never failed so far, but we check anyway
-		objbytes, byteerr := message.Object.Bytes()
-		if byteerr == nil {
-			werr = os.WriteFile(filename, objbytes, 0600)
-		} else {
-			werr = byteerr
+	// Hardlinks avoid writing the same content twice
+	// This fails across filesystems, so we fall back to writing
+	if source := message.linksource(); source != "" {
+		debug("Linking " + source + " to " + filename + "\n")
+		if os.Link(source, filename) == nil {
+			return true, nil
 		}
-	} else {
-		werr = os.WriteFile(filename, []byte(message.Raw), 0600)
 	}
 
-	return werr == nil, werr
-}
+	debug("Writing to " + filename + "\n")
+	input, werr := message_reader(message)
+	if werr == nil {
+		werr = copy_reader(input, filename)
+		input.Close()
+	}
 
-func file_exists(filename string) bool {
-	debug("START file_exists: " + filename + "\n")
-	_, err := os.Stat(filename)
-	return !os.IsNotExist(err)
+	return werr == nil, werr
 }
 
-func rewrite_domain(domain string) string {
-	// Query DB for domain rewrite
-	var rewrite sql.NullString
-	stmt1, err := db.Prepare("SELECT rewrite FROM domains WHERE domain = ? AND rewrite != ''")
+func copy_reader(input io.Reader, target string) error {
+	output, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
 	if err != nil {
-		debug("Failed to prepare statement in rewrite_domain")
-		os.Exit(111)
+		return err
 	}
 
-	rows1, err := stmt1.Query(domain)
+	_, err = io.Copy(output, input)
 	if err != nil {
-		debug("Failed to execute query in rewrite_domain")
-		os.Exit(111)
+		output.Close()
+		return err
 	}
-	defer stmt1.Close()
 
-	for rows1.Next() {
-		err := rows1.Scan(&rewrite)
-		if err != nil {
-			debug("Failed to scan row in rewrite_domain " + err.Error())
-			os.Exit(111)
-		}
-	}
+	return output.Close()
+}
 
-	// See https://stackoverflow.com/questions/40092155/difference-between-string-and-sql-nullstring
-	if rewrite.Valid {
-		return rewrite.String
-	}
-	return domain
+func file_exists(filename string) bool {
+	debug("START file_exists: " + filename + "\n")
+	_, err := os.Stat(filename)
+	return !os.IsNotExist(err)
 }
 
-func get_destinations(user string, domain string) []destination {
+func load_destinations(user string, domain string) (string, bool, []destination) {
 	var result []destination
-	var homedir string
-	var spamdir string
-	var dbhomedir string
-	var dbspamdir string
-
-	debug("Running query in get_destinations\n")
-
-	// go-mysql-driver can't handle IN, so we go this route
-	rows1, err := db.Query("SELECT DISTINCT COALESCE(homedir,''), COALESCE(spamdir,'') FROM passwd WHERE uid IN (" + ints_to_list(email_to_uids(user, domain)) + ")")
+	var rewritten string
+	var wildcard bool
+	inbox := chomp(file_content(configdir + "/inbox"))
+
+	// The derived table always returns a row, so the rewritten domain is
+	// known even without a mapping. Exact mappings sort before `*`
+	debug("Running query in load_destinations\n")
+	rows1, err := db.Query("SELECT target.domain, COALESCE(mapping.user,''), passwd.uid, COALESCE(passwd.username,''), COALESCE(passwd.homedir,''), COALESCE(passwd.spamdir,''), "+
+		"COALESCE(passwd.quota,0), COALESCE(passwd.extensions,0), COALESCE(passwd.locked,0) > 0, "+
+		"COALESCE(passwd.antispam,0) > 0, COALESCE(passwd.antivir,0) > 0, COALESCE(passwd.attachfilter,0) > 0, COALESCE(passwd.autoresponder,0) > 0, "+
+		"COALESCE(passwd.dmarcreject,0) > 0, COALESCE(passwd.dupfilter,0) > 0, COALESCE(passwd.spamlimit,0), COALESCE(passwd.spamtag,''), "+
+		"COALESCE(passwd.arstart,0), COALESCE(passwd.arend,0), COALESCE(passwd.arinterval,0), COALESCE(passwd.artext,'') "+
+		"FROM (SELECT COALESCE((SELECT rewrite FROM domains WHERE domain = ? AND rewrite != '' LIMIT 1), ?) AS domain) AS target "+
+		"LEFT JOIN mapping ON mapping.domain = target.domain AND (mapping.user = ? OR mapping.user = '*') "+
+		"LEFT JOIN passwd ON passwd.uid = mapping.uid AND "+account_active+" "+
+		"ORDER BY mapping.user = '*', passwd.uid", domain, domain, user)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(111)
+		exit_delivery(111, "ERROR: "+err.Error())
 	}
+	defer rows1.Close()
 
+	// Several uids can share a homedir, the lowest uid owns the destination
+	owner := make(map[string]int)
 	i := 0
 	for rows1.Next() {
 		i++
-		debug(fmt.Sprintf("Scanning #%d row in get_destinations\n", i))
-		err := rows1.Scan(&dbhomedir, &dbspamdir)
+		debug(fmt.Sprintf("Scanning #%d row in load_destinations\n", i))
+		var mapuser string
+		var uid sql.NullInt64
+		var dbhomedir, dbspamdir string
+		var features [6]bool
+		dst := destination{}
+		err := rows1.Scan(&rewritten, &mapuser, &uid, &dst.Username, &dbhomedir, &dbspamdir,
+			&dst.Quota, &dst.Extensions, &dst.Locked,
+			&features[0], &features[1], &features[2], &features[3], &features[4], &features[5], &dst.Spamlimit, &dst.Spamtag,
+			&dst.Autoresponder.Start, &dst.Autoresponder.End, &dst.Autoresponder.Interval, &dst.Autoresponder.Text)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(111)
+			exit_delivery(111, "ERROR: "+err.Error())
+		}
+
+		// No mapping, or the account is not active
+		if !uid.Valid {
+			continue
+		}
+		// Wildcard mappings only apply if the user has no mapping of its own
+		if mapuser == "*" && len(result) > 0 && !wildcard {
+			break
+		}
+		wildcard = mapuser == "*"
+		dst.Uid = int(uid.Int64)
+
+		for n, feature := range []string{"antispam", "antivir", "attachfilter", "autoresponder", "dmarcreject", "dupfilter"} {
+			if features[n] {
+				dst.Features = append(dst.Features, feature)
+			}
+		}
+
+		// Default is one response per sender per week
+		if dst.Autoresponder.Interval <= 0 {
+			dst.Autoresponder.Interval = 604800
 		}
 
 		// By default we take the DB's homedir as-is
-		homedir = dbhomedir
+		dst.Default = dbhomedir
 
 		// Add `INBOX` suffix and make sure homedir is clean
 		if strings.HasPrefix(dbhomedir, "/") {
-			homedir = path.Clean(dbhomedir + "/" + chomp(file_content(configdir+"/inbox")))
+			dst.Default = path.Clean(dbhomedir + "/" + inbox)
 		}
 
 		// If `spamdir` is empty, we use `homedir` instead
 		// Otherwise, `spamdir` is a relative path to `homedir`, which we clean before using it
-		if dbspamdir == "" {
-			spamdir = homedir
+		// LMTP servers file spam themselves (e.g. Sieve on X-Spam-Flag)
+		if dbspamdir == "" || destination_type(dbhomedir) == "lmtp" {
+			dst.Spam = dst.Default
 		} else {
-			spamdir = path.Clean(dbhomedir + "/" + dbspamdir)
+			dst.Spam = path.Clean(dbhomedir + "/" + dbspamdir)
 		}
 
-		result = append(result, destination{homedir, spamdir})
+		// Same grouping as the old DISTINCT: largest quota, extensions if
+		// any uid allows them, locked only if all uids are locked
+		key := dbhomedir + "\x00" + dbspamdir
+		if n, ok := owner[key]; ok {
+			if dst.Quota > result[n].Quota {
+				result[n].Quota = dst.Quota
+			}
+			if dst.Extensions > result[n].Extensions {
+				result[n].Extensions = dst.Extensions
+			}
+			result[n].Locked = result[n].Locked && dst.Locked
+			continue
+		}
+		owner[key] = len(result)
+		result = append(result, dst)
+	}
+	if err := rows1.Err(); err != nil {
+		exit_delivery(111, "ERROR: "+err.Error())
+	}
+	if rewritten == "" {
+		rewritten = domain
 	}
 
-	debug("Reached end of get_destinations\n")
-	return result
+	debug("Reached end of load_destinations\n")
+	return rewritten, wildcard, result
 }
 
-func feature_enabled(user string, domain string, feature string) bool {
+func (d destination) feature(name string) bool {
 	// Currently supported:
 	// `antispam`
 	// `antivir`
+	// `attachfilter`
 	// `autoresponder`
+	// `dmarcreject`
 	// `dupfilter`
-	var count int
-	debug("Preparing statement in feature_enabled [" + feature + "]\n")
-	stmt1, err := db.Prepare("SELECT COUNT(" + feature + ") FROM passwd WHERE uid = ? AND " + feature + " > 0")
-	if err != nil {
-		debug("ERROR: Failed to prepare feature query [" + err.Error() + "]")
-		return false
+	for _, feature := range d.Features {
+		if feature == name {
+			return true
+		}
+	}
+	return false
+}
+
+func any_feature(destinations []destination, name string) bool {
+	for _, dst := range destinations {
+		if dst.feature(name) {
+			return true
+		}
 	}
-	debug("Running query in feature_enabled [" + feature + "]\n")
-	err = stmt1.QueryRow(email_to_uid(user, domain)).Scan(&count)
+	return false
+}
+
+func destination_uids(destinations []destination) []int {
+	var uids []int
+	for _, dst := range destinations {
+		uids = append(uids, dst.Uid)
+	}
+	return uids
+}
+
+func sysexec_message(command string, args []string, message email) ([]byte, int, error) {
+	// Same content as in a maildir, e.g. the quarantine notice and header edits
+	input, err := message_reader(message)
 	if err != nil {
-		debug("ERROR: Failed to get features from DB [" + err.Error() + "]")
-		return false
+		return nil, 111, err
 	}
+	defer input.Close()
 
-	return count > 0
+	return sysexec(command, args, input)
 }
 
-func sysexec(command string, args []string, input []byte) ([]byte, int, error) {
+func sysexec(command string, args []string, input io.Reader) ([]byte, int, error) {
 	var output bytes.Buffer
 
 	if !file_exists(command) {
@@ -567,7 +1477,7 @@ func sysexec(command string, args []string, input []byte) ([]byte, int, error) {
 	}
 
 	cmd := exec.Command(command, args...)
-	cmd.Stdin = bytes.NewBuffer(input)
+	cmd.Stdin = input
 	cmd.Stdout = &output
 	err := cmd.Run()
 
@@ -610,16 +1520,33 @@ func directory_filelist_recursive(directory string) ([]string, error) {
 	return filelist, nil
 }
 
-func is_duplicate(directory string, hash string) bool {
-	debug("Getting file list for " + directory + " in is_duplicate\n")
-	filelist, err := directory_filelist_recursive(directory)
+func is_duplicate(directory string, message email) bool {
+	// The index covers the whole mailbox, including all folders
+	debug("Reading duplicate index for " + directory + " in is_duplicate\n")
+	index, err := os.Open(maildir_root(directory) + "/qbox-dupindex")
 	if err != nil {
 		return false
 	}
+	defer index.Close()
 
-	// filelist can be empty, handle this
-	for _, file := range filelist {
-		if strings.Contains(file, hash) {
+	if err := unix.Flock(int(index.Fd()), unix.LOCK_SH); err != nil {
+		return false
+	}
+
+	// Message-ID is only used as a key if configured
+	msgid := message_id(message)
+	if !file_exists(configdir + "/dupfilter_messageid") {
+		msgid = ""
+	}
+
+	cutoff := time.Now().Unix() - dupfilter_window()
+	scanner := bufio.NewScanner(index)
+	for scanner.Scan() {
+		stamp, hash, id, ok := parse_dupindex_line(scanner.Text())
+		if !ok || stamp < cutoff {
+			continue
+		}
+		if hash == message.Sha1 || (msgid != "" && id == msgid) {
 			return true
 		}
 	}
@@ -627,7 +1554,79 @@ func is_duplicate(directory string, hash string) bool {
 	return false
 }
 
+func record_duplicate(directory string, message email) error {
+	index, err := os.OpenFile(maildir_root(directory)+"/qbox-dupindex", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	// The lock is released when the file is closed
+	if err := unix.Flock(int(index.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+
+	content, err := io.ReadAll(index)
+	if err != nil {
+		return err
+	}
+
+	// Prune entries that are outside the window
+	cutoff := time.Now().Unix() - dupfilter_window()
+	var entries []string
+	for _, line := range strings.Split(string(content), "\n") {
+		stamp, _, _, ok := parse_dupindex_line(line)
+		if ok && stamp >= cutoff {
+			entries = append(entries, line)
+		}
+	}
+	entries = append(entries, strings.TrimSpace(fmt.Sprintf("%d %s %s", time.Now().Unix(), message.Sha1, message_id(message))))
+
+	if err := index.Truncate(0); err != nil {
+		return err
+	}
+	_, err = index.WriteAt([]byte(strings.Join(entries, "\n")+"\n"), 0)
+	return err
+}
+
+func parse_dupindex_line(line string) (int64, string, string, bool) {
+	// Format is "<epoch> <sha1> [<message-id>]"
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return 0, "", "", false
+	}
+
+	stamp, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, "", "", false
+	}
+
+	if len(fields) > 2 {
+		return stamp, fields[1], fields[2], true
+	}
+	return stamp, fields[1], "", true
+}
+
+func dupfilter_window() int64 {
+	// Seconds a message is remembered by the duplicate filter, default is one week
+	window, err := strconv.ParseInt(chomp(file_content(configdir+"/dupfilter_window")), 10, 64)
+	if err != nil || window <= 0 {
+		return 604800
+	}
+	return window
+}
+
+func message_id(message email) string {
+	// Whitespace would break the index format
+	return strings.Join(strings.Fields(message.Header.Get("Message-ID")), "")
+}
+
 func destination_type(destination string) string {
+	// lmtp:unix:/path or lmtp:host:port
+	if strings.HasPrefix(destination, "lmtp:") {
+		return "lmtp"
+	}
+
 	if strings.HasPrefix(destination, "/") {
 		return "maildir"
 	}
@@ -643,7 +1642,7 @@ func destination_type(destination string) string {
 	return ""
 }
 
-func write_to_maildir(message email, directory string) (bool, error, int64) {
+func write_to_maildir(message *email, directory string, quota int64) (bool, error, int64) {
 	// If homedir is set to /dev/null, silently discard the message
 	if strings.HasPrefix(directory, "/dev/null") {
 		return true, nil, -1
@@ -656,18 +1655,40 @@ func write_to_maildir(message email, directory string) (bool, error, int64) {
 	if !directory_is_writable(directory) {
 		return false, errors.New("Permission denied"), -1
 	}
+	// Check quota (in KB) against `maildirsize` of the top-level maildir
+	root := maildir_root(directory)
+	if quota > 0 {
+		usage, err := maildirsize_usage(root, quota*1024)
+		if err != nil {
+			return false, err, -1
+		}
+		debug(fmt.Sprintf("Mailbox usage is %d of %d bytes\n", usage, quota*1024))
+		if usage+int64(message.Length+len(message.Prepend)) > quota*1024 {
+			return false, quota_exceeded, -1
+		}
+	}
 	// Example filename:
 	// 1576429450084839306.27056.bart.lordy.de.7a3e892ba01ce9899d101745da2757a81ac55779
 	filename := epoch() + `.` + strconv.Itoa(os.Getpid()) + `.` + sys_hostname() + `.` + message.Sha1
 	debug("Designated filename is " + filename + "\n")
-	writesuccess, err := write_to_file(message, directory+"/tmp/"+filename)
+	writesuccess, err := write_to_file(*message, directory+"/tmp/"+filename)
 	ondisk := filesize(directory + "/tmp/" + filename)
 
 	if writesuccess {
 		linkerr := os.Link(directory+"/tmp/"+filename, directory+"/new/"+filename)
 		if linkerr == nil {
+			// Later maildirs can link to this file
+			if message.modified() && message.Delivered == "" {
+				message.Delivered = directory + "/new/" + filename
+			}
 			rmerr := os.Remove(directory + "/tmp/" + filename)
 			if rmerr == nil {
+				if quota > 0 {
+					// Failing to update `maildirsize` should not fail the delivery
+					if err := maildirsize_update(root, ondisk); err != nil {
+						debug("Failed to update maildirsize [" + err.Error() + "]\n")
+					}
+				}
 				return true, nil, ondisk
 			} else {
 				return false, rmerr, ondisk
@@ -692,7 +1713,7 @@ func sys_hostname() string {
 
 func debug(message string) bool {
 	if debug_enabled {
-		fmt.Fprintf(os.Stderr, "DEBUG: "+message)
+		fmt.Fprint(os.Stderr, "DEBUG: "+message)
 		return true
 	}
 	return false
@@ -703,116 +1724,98 @@ func env_defined(key string) bool {
 	return exists
 }
 
-func autoresponder_history(user string, domain string, sender string, duration int) bool {
+func autoresponder_history(uid int, sender string, duration int) bool {
 	var count int
 	debug("Preparing statement in autoresponder_history\n")
 	stmt1, err := db.Prepare("SELECT COUNT(*) FROM responses WHERE uid = ? AND rcpt = ? AND time > (UNIX_TIMESTAMP() - " + strconv.Itoa(duration) + ")")
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(111)
+		exit_delivery(111, "ERROR: "+err.Error())
 	}
+	defer stmt1.Close()
 	debug("Running query in autoresponder_history\n")
-	err = stmt1.QueryRow(email_to_uid(user, domain), sender).Scan(&count)
+	err = stmt1.QueryRow(uid, sender).Scan(&count)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(111)
+		exit_delivery(111, "ERROR: "+err.Error())
 	}
 
 	return count > 0
 }
 
-func email_to_uid(user string, domain string) int {
-	// This is bad code because one email can map to multiple UIDs
-	var uid int = -1
-	debug("Preparing statement in email_to_uid\n")
-	stmt1, err := db.Prepare("SELECT passwd.uid FROM passwd INNER JOIN mapping ON passwd.uid = mapping.uid WHERE user = ? AND domain = ?")
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(111)
-	}
-	debug("Running query in email_to_uid\n")
-	err = stmt1.QueryRow(user, domain).Scan(&uid)
+func (a autoresponder) active(now int64) bool {
+	// A zero start or end leaves the window open on that side
+	return (a.Start == 0 || a.Start <= now) &&
+		(a.End == 0 || a.End >= now)
+}
 
-	// If the first query procudes no result, check for wildcard mapping
-	if err == sql.ErrNoRows {
-		err = stmt1.QueryRow("*", domain).Scan(&uid)
+func is_automated(message email, sender string) bool {
+	// Bounces have an empty envelope sender
+	if sender == "" {
+		return true
 	}
 
-	// If error is still not nil, we have no mapping and need to defer delivery
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(111)
+	// RFC 3834, section 2: don't respond to list and system addresses
+	local := strings.ToLower(strings.Split(sender, "@")[0])
+	if strings.HasPrefix(local, "noreply") ||
+		strings.HasPrefix(local, "no-reply") ||
+		strings.HasPrefix(local, "owner-") ||
+		strings.HasSuffix(local, "-request") ||
+		local == "mailer-daemon" ||
+		local == "postmaster" {
+		return true
 	}
 
-	return uid
-}
-
-func email_to_uids(user string, domain string) []int {
-	// This is bad code because one email can map to multiple UIDs
-	var uids []int
-	var rows *sql.Rows
-
-	debug("Preparing statement in email_to_uids\n")
-	stmt1, err := db.Prepare("SELECT passwd.uid FROM passwd INNER JOIN mapping ON passwd.uid = mapping.uid WHERE user = ? AND domain = ?")
-	//	stmt1, err := db.Prepare("SELECT DISTINCT passwd.uid FROM passwd INNER JOIN mapping ON passwd.uid = mapping.uid WHERE (user = ? OR user = '*') AND domain = ?")
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(111)
+	// Anything but `Auto-Submitted: no` was generated automatically
+	autosubmitted := strings.ToLower(strings.TrimSpace(message.Header.Get("Auto-Submitted")))
+	if autosubmitted != "" && !strings.HasPrefix(autosubmitted, "no") {
+		return true
 	}
-	debug("Running query in email_to_uids\n")
-	rows, err = stmt1.Query(user, domain)
 
-	// If the first query procudes no result, check for wildcard mapping
-	// This only works for QueryRow(), not Query()
-	//	if err == sql.ErrNoRows {
-	//		rows, err = stmt1.Query("*", domain)
-	//	}
-
-	// Iterate over results
-	for rows.Next() {
-		var nextuid int
-		rows.Scan(&nextuid)
-		uids = append(uids, nextuid)
+	switch strings.ToLower(strings.TrimSpace(message.Header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return true
 	}
 
-	if len(uids) == 0 {
-		debug("User search returned no results, trying wildcard\n")
-		stmt2, _ := db.Prepare("SELECT passwd.uid FROM passwd INNER JOIN mapping ON passwd.uid = mapping.uid WHERE user = '*' AND domain = ?")
-		rows, _ = stmt2.Query(domain)
-
-		for rows.Next() {
-			var nextuid int
-			rows.Scan(&nextuid)
-			uids = append(uids, nextuid)
+	// Mailing lists (RFC 2369 and RFC 2919)
+	for key := range message.Header {
+		if strings.HasPrefix(key, "List-") {
+			return true
 		}
 	}
 
-	// If error is still not nil, we have no mapping and need to defer delivery
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(111)
+	// Outlook's way of asking for no auto replies
+	suppress := strings.ToLower(message.Header.Get("X-Auto-Response-Suppress"))
+	if strings.Contains(suppress, "all") || strings.Contains(suppress, "oof") {
+		return true
 	}
 
-	debug(fmt.Sprintf("Returning %d results from email_to_uids: %s\n", len(uids), ints_to_list(uids)))
-	return uids
+	return false
 }
 
-func autoresponder_text(user string, domain string) string {
-	var artext string
-	debug("Preparing statement in autresponder_text\n")
-	stmt1, err := db.Prepare("SELECT artext FROM passwd WHERE uid = ?")
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(111)
+func autoresponder_reply(message email, sender string, text string) *jwemail.Email {
+	ar := jwemail.NewEmail()
+	ar.From = "<" + message.Recipient + ">"
+	ar.To = []string{"<" + sender + ">"}
+
+	subject := header_values(message, "Subject")
+	if len(subject) == 0 || subject[0] == "" {
+		ar.Subject = "Autoresponder reply"
+	} else {
+		ar.Subject = "Auto: " + subject[0]
 	}
-	debug("Running query in autresponder_text\n")
-	err = stmt1.QueryRow(email_to_uid(user, domain)).Scan(&artext)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(111)
+
+	// RFC 3834, section 3.1.5 and 3.1.7
+	ar.Headers.Set("Auto-Submitted", "auto-replied")
+	if msgid := strings.TrimSpace(message.Header.Get("Message-ID")); msgid != "" {
+		ar.Headers.Set("In-Reply-To", msgid)
+		references := strings.TrimSpace(message.Header.Get("References"))
+		if references == "" {
+			references = strings.TrimSpace(message.Header.Get("In-Reply-To"))
+		}
+		ar.Headers.Set("References", strings.TrimSpace(references+" "+msgid))
 	}
 
-	return artext
+	ar.Text = []byte(text)
+	return ar
 }
 
 func record_autoresponse(from int, to string) bool {
@@ -822,14 +1825,70 @@ func record_autoresponse(from int, to string) bool {
 		fmt.Println(err)
 		return false
 	}
+	defer stmt1.Close()
 	debug("Running query in record_autoresponse\n")
 	_, err = stmt1.Exec(from, to)
 
 	return err == nil
 }
 
-func array_sum(input []int) int {
-	var sum int
+func journal_key(dst destination) string {
+	// The spam verdict may change between attempts, the uid and mailbox don't
+	return strconv.Itoa(dst.Uid) + ":" + dst.Default
+}
+
+func journal_window() int64 {
+	// Seconds a partial delivery is remembered, default is qmail's queuelifetime
+	window, err := strconv.ParseInt(chomp(file_content(configdir+"/journal_window")), 10, 64)
+	if err != nil || window <= 0 {
+		return 604800
+	}
+	return window
+}
+
+func journal_completed(message email) map[string]bool {
+	result := make(map[string]bool)
+
+	debug("Running query in journal_completed\n")
+	rows, err := db.Query("SELECT destination FROM journal WHERE sha1 = ? AND rcpt = ? AND time > (UNIX_TIMESTAMP() - ?)", message.Sha1, message.Recipient, journal_window())
+	if err != nil {
+		// Without the journal we deliver everything, like before
+		debug("ERROR: Failed to read delivery journal [" + err.Error() + "]\n")
+		return result
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var destination string
+		if rows.Scan(&destination) == nil {
+			result[destination] = true
+		}
+	}
+	return result
+}
+
+func record_journal(message email, key string) error {
+	debug("Running query in record_journal\n")
+	_, err := db.Exec("INSERT INTO journal (sha1, rcpt, destination, time) VALUES (?, ?, ?, UNIX_TIMESTAMP())", message.Sha1, message.Recipient, key)
+	if err != nil {
+		return err
+	}
+
+	// Prune entries of messages that were never retried successfully
+	_, err = db.Exec("DELETE FROM journal WHERE time < (UNIX_TIMESTAMP() - ?)", journal_window())
+	return err
+}
+
+func clear_journal(message email) {
+	debug("Running query in clear_journal\n")
+	_, err := db.Exec("DELETE FROM journal WHERE sha1 = ? AND rcpt = ?", message.Sha1, message.Recipient)
+	if err != nil {
+		debug("ERROR: Failed to clear delivery journal [" + err.Error() + "]\n")
+	}
+}
+
+func array_sum(input []int) int {
+	var sum int
 	for _, i := range input {
 		sum += i
 	}
@@ -880,34 +1939,507 @@ func file_content(filename string) string {
 	return ""
 }
 
-func spamd_scan(input *string) (*spamc.ResponseCheck, error) {
-	var spamd_url string = "127.0.0.1:783"
-	// read config file
-	if file_exists(configdir + "/spamd") {
-		spamd_url = file_content(configdir + "/spamd")
+func locked_policy() string {
+	switch policy := chomp(file_content(configdir + "/locked_policy")); policy {
+	case locked_defer, locked_bounce:
+		return policy
 	}
-	// initialize client
-	spamc := spamc.New(spamd_url, &net.Dialer{Timeout: 2 * time.Second})
-	// do scan
-	check, err := spamc.Check(context.Background(), strings.NewReader(*input), nil)
-	return check, err
+	return locked_deliver
 }
 
-func clamd_scan(input *string) (*clamd.Response, error) {
-	var clamd_url string = "127.0.0.1:3310"
-	// read config file
-	if file_exists(configdir + "/clamd") {
-		clamd_url = file_content(configdir + "/clamd")
+func scanfail_policy(domain string) string {
+	// The domain's policy overrides the global one
+	var policy string
+	err := db.QueryRow("SELECT COALESCE(scanfail,'') FROM domains WHERE domain = ?", domain).Scan(&policy)
+	if err != nil && err != sql.ErrNoRows {
+		debug("Failed to get scanfail policy [" + err.Error() + "]\n")
 	}
-	// initialize client
-	clamc, _ := clamd.NewClient("tcp", clamd_url)
-	// do scan
-	avresult, err := clamc.ScanReader(context.Background(), strings.NewReader(*input))
-	if err == nil {
-		return avresult[0], err
-	} else {
-		return nil, err
+	if policy == "" {
+		policy = chomp(file_content(configdir + "/scanfail_policy"))
+	}
+
+	switch policy {
+	case scanfail_defer, scanfail_spam:
+		return policy
+	}
+	return scanfail_tag
+}
+
+func defer_scanfail(session string, start time.Time, dreport report, message email, sender string) {
+	// The report is logged first, so it shows the scanner error
+	finish_early(session, start, dreport, message, sender, 111)
+	exit_delivery(111, "Scanner unavailable, deferring delivery")
+}
+
+func apply_scanfail(policy string, message *email, header string) bool {
+	// Returns true if the delivery has to be deferred, see `defer_scanfail`
+	// With the `spam` policy, the caller marks the affected destinations
+	if policy == scanfail_defer && explain_enabled {
+		explain("scanfail", "delivery would be deferred (exit 111)")
+		return false
+	}
+	if policy == scanfail_defer {
+		return true
+	}
+
+	message.set_header(header, "failed")
+	return false
+}
+
+func get_scanners() []scanner {
+	// Without `scanners`, the old `spamd` and `clamd` files are used
+	if !file_exists(configdir + "/scanners") {
+		spamd_url := "127.0.0.1:783"
+		if file_exists(configdir + "/spamd") {
+			spamd_url = chomp(file_content(configdir + "/spamd"))
+		}
+		clamd_url := "127.0.0.1:3310"
+		if file_exists(configdir + "/clamd") {
+			clamd_url = chomp(file_content(configdir + "/clamd"))
+		}
+		return []scanner{
+			spamassassin_scanner{scannerconf{Address: spamd_url, Timeout: 30 * time.Second, Weight: 1}},
+			clamav_scanner{scannerconf{Address: clamd_url, Timeout: 30 * time.Second, Weight: 1}},
+		}
+	}
+
+	var result []scanner
+	for _, line := range strings.Split(file_content(configdir+"/scanners"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		conf := scannerconf{Address: fields[1], Timeout: 30 * time.Second, Weight: 1}
+		for _, option := range fields[2:] {
+			key, value, _ := strings.Cut(option, "=")
+			switch key {
+			case "timeout":
+				if timeout, err := time.ParseDuration(value); err == nil {
+					conf.Timeout = timeout
+				}
+			case "weight":
+				if weight, err := strconv.ParseFloat(value, 64); err == nil && weight >= 0 {
+					conf.Weight = weight
+				}
+			case "password":
+				conf.Password = value
+			}
+		}
+
+		switch fields[0] {
+		case "spamassassin":
+			result = append(result, spamassassin_scanner{conf})
+		case "rspamd":
+			result = append(result, rspamd_scanner{conf})
+		case "clamav":
+			result = append(result, clamav_scanner{conf})
+		default:
+			debug("Ignoring unknown scanner type " + fields[0] + "\n")
+		}
+	}
+
+	return result
+}
+
+// SpamAssassin's default required_score
+const spam_reference = 5.0
+
+func run_scanners(scanners []scanner, kind string, message email, sender string, user string) (verdict, []verdict, error) {
+	var result verdict
+	var verdicts []verdict
+	var names []string
+	var failures []string
+	var weights, spamweights float64
+	var succeeded []verdict
+	var succeededweights []float64
+
+	// Backends run in the configured order
+	for _, backend := range scanners {
+		if backend.kind() != kind {
+			continue
+		}
+		debug("Scanning with " + backend.name() + " at " + backend.config().Address + "\n")
+		single, err := backend.scan(message, sender, user)
+		single.Scanner = backend.name()
+		if err != nil {
+			single.Error = err.Error()
+			verdicts = append(verdicts, single)
+			failures = append(failures, backend.name()+": "+err.Error())
+			continue
+		}
+		verdicts = append(verdicts, single)
+		names = append(names, backend.name())
+		succeeded = append(succeeded, single)
+
+		// The score is the weighted average, spam needs a weighted majority
+		weight := backend.config().Weight
+		weights += weight
+		succeededweights = append(succeededweights, weight)
+		result.Rules = append(result.Rules, single.Rules...)
+		if single.Spam {
+			spamweights += weight
+		}
+		if single.Virus != "" && result.Virus == "" {
+			result.Virus = single.Virus
+		}
+	}
+
+	if len(failures) == 0 && len(names) == 0 {
+		return result, verdicts, errors.New("No " + kind + " scanner configured")
+	}
+	if len(names) == 0 {
+		return result, verdicts, errors.New("No " + kind + " scanner succeeded (" + strings.Join(failures, "; ") + ")")
+	}
+
+	// Scanners use different scales (rspamd rejects at 15), so scores are
+	// only scaled if they are combined with a different one, see `spam_scale`
+	reference := spam_scale(succeeded)
+	for i, single := range succeeded {
+		scale := 1.0
+		if reference > 0 && single.Required > 0 {
+			scale = reference / single.Required
+		}
+		result.Score += single.Score * scale * succeededweights[i]
+		result.Required += single.Required * scale * succeededweights[i]
+	}
+
+	if weights > 0 {
+		result.Score = result.Score / weights
+		result.Required = result.Required / weights
+		result.Spam = spamweights*2 > weights
+	}
+	result.Scanner = strings.Join(names, ", ")
+	return result, verdicts, nil
+}
+
+func spam_scale(verdicts []verdict) float64 {
+	// Returns 0 if all scores have the same scale, they are then used as is
+	// Otherwise SpamAssassin's required score is the reference, as `spamlimit`
+	// is based on SpamAssassin's scale
+	same := true
+	for _, single := range verdicts {
+		same = same && single.Required == verdicts[0].Required
+	}
+	if same {
+		return 0
+	}
+
+	for _, single := range verdicts {
+		if single.Scanner == (spamassassin_scanner{}).name() && single.Required > 0 {
+			return single.Required
+		}
+	}
+	return spam_reference
+}
+
+func header_verdict(result verdict, verdicts []verdict) verdict {
+	// X-Spam-Status and X-Spam-Report show SpamAssassin's own score, so it
+	// matches the rule points. Without SpamAssassin the combined score is used
+	for _, single := range verdicts {
+		if single.Scanner == (spamassassin_scanner{}).name() && single.Error == "" {
+			return single
+		}
+	}
+	return result
+}
+
+func spam_tests(result verdict) string {
+	var names []string
+	for _, rule := range result.Rules {
+		names = append(names, rule.Name)
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func spam_status(result verdict, isspam bool, required float64) string {
+	// Same layout as SpamAssassin's own header, so existing client filters match
+	// Yes/No and required are the uid's (`spamlimit`), which decided the folder
+	status := fmt.Sprintf("%s, score=%.1f required=%.1f tests=", bool_yesno(isspam), result.Score, required)
+
+	// Long rule lists are folded after a comma
+	line := status
+	status = ""
+	for i, name := range strings.Split(spam_tests(result), ",") {
+		if i > 0 {
+			line += ","
+			if len(line)+len(name) > 70 {
+				status += line + "\n\t"
+				line = ""
+			}
+		}
+		line += name
+	}
+	return status + line
+}
+
+func spam_report(result verdict) string {
+	// One folded line per rule, e.g. "*  1.2 MISSING_HEADERS Missing To: header"
+	var report string
+	for _, rule := range result.Rules {
+		description := strings.Join(strings.Fields(rule.Description), " ")
+		report += fmt.Sprintf("\n\t* %4.1f %s %s", rule.Score, rule.Name, description)
+	}
+	return strings.TrimRight(report, " ")
+}
+
+func uid_headers(message *email, dst destination) string {
+	// Returns the values that were set, copies with the same values are identical
+	var values []string
+	set := func(name string, value string) {
+		message.set_header(name, value)
+		values = append(values, name+": "+value)
+	}
+
+	if result := dst.Spamresult; result != nil {
+		set("X-Spam-Flag", bool_yesno(dst.IsSpam))
+		set("X-Spam-Level", strings.Repeat(`*`, not_negative(int(result.Score))))
+		set("X-Spam-Status", spam_status(*result, dst.IsSpam, dst.Spamlimit))
+		if file_exists(configdir+"/spam_report") && len(result.Rules) > 0 {
+			set("X-Spam-Report", spam_report(*result))
+		}
+	}
+
+	if dst.IsSpam && dst.Spamtag != "" && !dst.Quarantine {
+		tag_subject(message, dst.Spamtag)
+		values = append(values, "Subject: "+dst.Spamtag)
+		explain("spamtag", fmt.Sprintf("uid %d: Subject tagged with %s", dst.Uid, dst.Spamtag))
+	}
+
+	return strings.Join(values, "\x00")
+}
+
+func tag_subject(message *email, tag string) {
+	// The raw value is kept, encoded words stay encoded behind the tag
+	subject := message.Header.Get("Subject")
+	if strings.HasPrefix(subject, tag) {
+		return
+	}
+	message.set_header("Subject", strings.TrimSpace(tag+" "+subject))
+}
+
+func (s spamassassin_scanner) scan(message email, sender string, user string) (result verdict, err error) {
+	// spamc panics instead of returning an error if spamd can't be reached
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("could not talk to spamd at %s", s.Address)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+
+	client := spamc.New(s.Address, &net.Dialer{Timeout: s.Timeout})
+	input, err := message.open()
+	if err != nil {
+		return result, err
+	}
+	defer input.Close()
+	// With a user, spamd loads the user's preferences (e.g. SQL user_prefs) and Bayes DB
+	var header spamc.Header
+	if user != "" {
+		header = spamc.Header{}.Set("User", user)
+	}
+	// REPORT instead of CHECK, it also returns the matched rules
+	check, err := client.Report(ctx, input, header)
+	if err != nil {
+		return result, err
+	}
+
+	result.Spam = check.IsSpam
+	result.Score = check.Score
+	result.Required = check.BaseScore
+	for _, line := range check.Report.Table {
+		result.Rules = append(result.Rules, spamrule{Name: line.Rule, Score: line.Points, Description: line.Description})
+	}
+	return result, nil
+}
+
+func (s rspamd_scanner) scan(message email, sender string, user string) (verdict, error) {
+	var result verdict
+
+	input, err := message.open()
+	if err != nil {
+		return result, err
+	}
+	defer input.Close()
+
+	request, err := http.NewRequest("POST", strings.TrimSuffix(s.Address, "/")+"/checkv2", input)
+	if err != nil {
+		return result, err
+	}
+
+	// Envelope data lets rspamd run its SPF and RBL checks
+	request.Header.Set("From", sender)
+	request.Header.Set("Rcpt", message.Recipient)
+	request.Header.Set("Deliver-To", message.Recipient)
+	if user != "" {
+		request.Header.Set("User", user)
+	}
+	if ip, helo := received_client(message); ip != nil {
+		request.Header.Set("IP", ip.String())
+		request.Header.Set("Helo", helo)
+	}
+	if s.Password != "" {
+		request.Header.Set("Password", s.Password)
+	}
+
+	client := &http.Client{Timeout: s.Timeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return result, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return result, errors.New("rspamd returned " + response.Status)
+	}
+
+	var check struct {
+		Score    float64 `json:"score"`
+		Required float64 `json:"required_score"`
+		Action   string  `json:"action"`
+		Error    string  `json:"error"`
+		Symbols  map[string]struct {
+			Score       float64 `json:"score"`
+			Description string  `json:"description"`
+		} `json:"symbols"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&check)
+	if err != nil {
+		return result, err
+	}
+	if check.Error != "" {
+		return result, errors.New(check.Error)
+	}
+
+	// Everything but "no action" and "greylist" means rspamd considers it spam
+	result.Score = check.Score
+	result.Required = check.Required
+	result.Spam = check.Action != "no action" && check.Action != "greylist"
+	for name, symbol := range check.Symbols {
+		result.Rules = append(result.Rules, spamrule{Name: name, Score: symbol.Score, Description: symbol.Description})
+	}
+	// Symbols come as a JSON object, sorted they stay the same between runs
+	sort.Slice(result.Rules, func(i, j int) bool { return result.Rules[i].Name < result.Rules[j].Name })
+	return result, nil
+}
+
+func (s clamav_scanner) scan(message email, sender string, user string) (verdict, error) {
+	var result verdict
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+
+	client, err := clamd.NewClient("tcp", s.Address)
+	if err != nil {
+		return result, err
+	}
+	client.SetConnTimeout(s.Timeout)
+	client.SetCmdTimeout(s.Timeout)
+
+	input, err := message.open()
+	if err != nil {
+		return result, err
+	}
+	defer input.Close()
+	avresults, err := client.ScanReader(ctx, input)
+	if err != nil {
+		return result, err
+	}
+	if len(avresults) == 0 {
+		return result, errors.New("empty response from clamd")
+	}
+
+	switch avresults[0].Status {
+	case "OK":
+	case "FOUND":
+		result.Virus = avresults[0].Signature
+	default:
+		return result, errors.New("clamd returned " + avresults[0].Raw)
+	}
+	return result, nil
+}
+
+func quarantine_directory() string {
+	if file_exists(configdir + "/quarantine") {
+		return chomp(file_content(configdir + "/quarantine"))
+	}
+	return "/var/qmail/quarantine"
+}
+
+func quarantine_message(message email, sender string, virus string) (string, error) {
+	directory := quarantine_directory()
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	token := uuid.NewString()
+	input, err := message.open()
+	if err != nil {
+		return "", err
+	}
+	err = copy_reader(input, directory+"/"+token+".eml")
+	input.Close()
+	if err != nil {
+		return "", err
+	}
+
+	metadata, _ := json.Marshal(quarantined{
+		Token:     token,
+		Virus:     virus,
+		Sender:    sender,
+		Recipient: message.Recipient,
+		Sha1:      message.Sha1,
+		Size:      message.Length,
+		Time:      time.Now().Unix(),
+	})
+	// Without metadata the message can't be released, so don't keep it
+	err = os.WriteFile(directory+"/"+token+".json", metadata, 0600)
+	if err != nil {
+		os.Remove(directory + "/" + token + ".eml")
+		return "", err
+	}
+
+	return token, nil
+}
+
+func quarantine_notice(message email, sender string, reason string, token string) *jwemail.Email {
+	notice := jwemail.NewEmail()
+	notice.From = "MAILER-DAEMON@" + sys_hostname()
+	notice.To = []string{message.Recipient}
+	notice.Subject = "Message quarantined: " + strings.Join(header_values(message, "Subject"), " ")
+	notice.Headers.Set("Auto-Submitted", "auto-generated")
+	notice.Headers.Set("Date", time.Now().Format(time.RFC1123Z))
+	notice.Text = []byte("A message to you was quarantined because it contains a virus\n" +
+		"or an attachment that is not allowed.\n\n" +
+		"Sender:  " + sender + "\n" +
+		"From:    " + message.Header.Get("From") + "\n" +
+		"Subject: " + strings.Join(header_values(message, "Subject"), " ") + "\n" +
+		"Reason:  " + reason + "\n\n" +
+		"If you believe this is a mistake, contact your administrator\n" +
+		"and quote the following release token:\n\n" +
+		"    " + token + "\n")
+	return notice
+}
+
+func is_released(token string, message email) bool {
+	// Tokens are UUIDs, anything else could escape the quarantine directory
+	if _, err := uuid.Parse(token); err != nil {
+		return false
+	}
+
+	var item quarantined
+	if json.Unmarshal([]byte(file_content(quarantine_directory()+"/"+token+".json")), &item) != nil {
+		return false
 	}
+
+	// The token is only valid for the message it was issued for
+	return item.Token == token && item.Sha1 == message.Sha1
 }
 
 func directory_is_writable(directory string) bool {
@@ -924,6 +2456,82 @@ func forward_sender() string {
 	return "postmaster@" + sys_hostname()
 }
 
+func forward_envelope(sender string) string {
+	// Bounces and setups without SRS use the static forward_sender
+	secret := chomp(file_content(configdir + "/srs_secret"))
+	if sender == "" || secret == "" {
+		return forward_sender()
+	}
+
+	srsaddress, err := srs_forward(sender, srs_domain(), secret, time.Now())
+	if err != nil {
+		debug("SRS rewrite failed for " + sender + " [" + err.Error() + "]\n")
+		return forward_sender()
+	}
+
+	debug("SRS rewrite: " + sender + " -> " + srsaddress + "\n")
+	return srsaddress
+}
+
+func srs_domain() string {
+	if file_exists(configdir + "/srs_domain") {
+		return chomp(file_content(configdir + "/srs_domain"))
+	}
+
+	// Fall back to the domain of forward_sender
+	parts := strings.Split(forward_sender(), "@")
+	return parts[len(parts)-1]
+}
+
+// Sender Rewriting Scheme, compatible with libsrs2 and Mail::SRS
+// SRS0=HHHH=TT=domain=local@srsdomain for original senders
+// SRS1=HHHH=srshost==HHHH=TT=domain=local@srsdomain for SRS0 senders
+func srs_forward(sender string, domain string, secret string, now time.Time) (string, error) {
+	at := strings.LastIndex(sender, "@")
+	if at < 1 || at == len(sender)-1 {
+		return "", errors.New("Invalid sender address")
+	}
+	local, host := sender[:at], sender[at+1:]
+
+	// Already rewritten by another forwarder, keep the first hop
+	if srs_hastag(local, "SRS0") {
+		opaque := local[4:]
+		return "SRS1=" + srs_hash(secret, host, opaque) + "=" + host + "=" + opaque + "@" + domain, nil
+	}
+	if srs_hastag(local, "SRS1") {
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) != 3 {
+			return "", errors.New("Invalid SRS1 address")
+		}
+		srshost, opaque := parts[1], parts[2]
+		return "SRS1=" + srs_hash(secret, srshost, opaque) + "=" + srshost + "=" + opaque + "@" + domain, nil
+	}
+
+	timestamp := srs_timestamp(now)
+	return "SRS0=" + srs_hash(secret, timestamp, host, local) + "=" + timestamp + "=" + host + "=" + local + "@" + domain, nil
+}
+
+func srs_hastag(local string, tag string) bool {
+	return len(local) > 5 &&
+		strings.EqualFold(local[:4], tag) &&
+		strings.ContainsAny(local[4:5], "=+-")
+}
+
+func srs_hash(secret string, data ...string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	for _, item := range data {
+		mac.Write([]byte(strings.ToLower(item)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:4]
+}
+
+func srs_timestamp(now time.Time) string {
+	// Days since epoch, modulo 1024, as two base32 characters
+	const base32 = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	days := (now.Unix() / 86400) % 1024
+	return string([]byte{base32[days>>5], base32[days&31]})
+}
+
 func chomp(s string) string {
 	return strings.TrimRight(s, "\n")
 }
@@ -935,12 +2543,59 @@ func not_negative(i int) int {
 	return i
 }
 
-func remove_extension(s string) string {
+func split_extension(s string, delimiter string) (string, string) {
 	// https://stackoverflow.com/a/29581738
-	if idx := strings.Index(s, "+"); idx != -1 {
-		return s[:idx]
+	if idx := strings.Index(s, delimiter); idx != -1 {
+		return s[:idx], s[idx+len(delimiter):]
+	}
+	return s, ""
+}
+
+func extension_delimiter() string {
+	delimiter := strings.TrimSpace(file_content(configdir + "/extension_delimiter"))
+	if delimiter == "" {
+		return "+"
+	}
+	return delimiter
+}
+
+func extensions_allowed(destinations []destination) bool {
+	// One recipient with extensions enabled is enough (e.g. group mappings)
+	for _, dst := range destinations {
+		if dst.Extensions != extensions_off {
+			return true
+		}
+	}
+	return false
+}
+
+func extension_folder(dst destination, extension string) string {
+	if dst.Extensions == extensions_off ||
+		destination_type(dst.Default) != "maildir" {
+		return ""
+	}
+
+	folder := "." + extension
+	if !is_valid_folder(folder) {
+		return ""
+	}
+
+	dir := path.Clean(dst.Default + "/" + folder)
+	if is_valid_maildir(dir) {
+		return dir
+	}
+
+	// Without the folder, the message goes to INBOX
+	if dst.Extensions == extensions_create && explain_enabled {
+		explain("folder", dir+" would be created")
+		return dir
+	}
+	if dst.Extensions == extensions_create {
+		if err := create_maildir(dir); err == nil {
+			return dir
+		}
 	}
-	return s
+	return ""
 }
 
 func list_destinations(dst []destination) string {
@@ -959,25 +2614,6 @@ func is_valid_maildir(dir string) bool {
 		directory_is_writable(dir+"/tmp")
 }
 
-func user_spamlimit(user string, domain string) float64 {
-	var spamlimit float64
-
-	debug("Preparing statement in user_spamlimit\n")
-	stmt1, err := db.Prepare("SELECT COALESCE(spamlimit,0) FROM passwd WHERE uid = ?")
-	if err != nil {
-		fmt.Println(err)
-		return 0
-	}
-
-	debug("Running query in user_spamlimit\n")
-	err = stmt1.QueryRow(email_to_uid(user, domain)).Scan(&spamlimit)
-
-	if err != nil {
-		return 100
-	}
-	return spamlimit
-}
-
 func filesize(filename string) int64 {
 	fi, err := os.Stat(filename)
 	if err != nil {
@@ -988,6 +2624,10 @@ func filesize(filename string) int64 {
 }
 
 func syslog_write(message string) error {
+	// Explaining must not leave traces in the mail log
+	if explain_enabled {
+		return nil
+	}
 	// If run in debug mode, we write to STDERR, not syslog
 	if debug_enabled {
 		fmt.Fprint(os.Stderr, message)
@@ -1012,3 +2652,1630 @@ func ints_to_list(ints []int) string {
 
 	return "NULL"
 }
+
+func get_filterrules(uid int) []filterrule {
+	var result []filterrule
+
+	debug("Preparing statement in get_filterrules\n")
+	stmt1, err := db.Prepare("SELECT filter.id, filter.applyto, filters.expression, filter.destination, filter.value FROM filter INNER JOIN filters ON filter.filter = filters.id WHERE filter.uid = ? ORDER BY filter.id")
+	if err != nil {
+		exit_delivery(111, "ERROR: "+err.Error())
+	}
+	defer stmt1.Close()
+
+	debug("Running query in get_filterrules\n")
+	rows1, err := stmt1.Query(uid)
+	if err != nil {
+		exit_delivery(111, "ERROR: "+err.Error())
+	}
+	defer rows1.Close()
+
+	for rows1.Next() {
+		var rule filterrule
+		err := rows1.Scan(&rule.Id, &rule.Applyto, &rule.Expression, &rule.Destination, &rule.Value)
+		if err != nil {
+			exit_delivery(111, "ERROR: "+err.Error())
+		}
+		result = append(result, rule)
+	}
+
+	debug(fmt.Sprintf("Found %d filter rules for uid %d\n", len(result), uid))
+	return result
+}
+
+func apply_filters(dst destination, message email, sender string, isspam bool) string {
+	// `isspam` is the uid's verdict, see `destination.IsSpam`
+	// Rules are evaluated in order, the first match wins
+	for _, rule := range get_filterrules(dst.Uid) {
+		if rule.Applyto == applyto_ham && isspam {
+			continue
+		}
+		if rule.Applyto == applyto_spam && !isspam {
+			continue
+		}
+		if !filter_matches(rule, message, sender) {
+			continue
+		}
+
+		debug(fmt.Sprintf("Filter rule %d matched [%s %s]\n", rule.Id, rule.Expression, rule.Value))
+
+		// Folders are relative to the user's maildir
+		if strings.HasPrefix(rule.Destination, ".") {
+			if !is_valid_folder(rule.Destination) {
+				syslog_write(fmt.Sprintf("Ignoring filter rule %d with invalid folder %s", rule.Id, rule.Destination))
+				continue
+			}
+			folder := path.Clean(dst.Default + "/" + rule.Destination)
+			if !is_valid_maildir(folder) && explain_enabled {
+				explain("folder", folder+" would be created")
+			} else if !is_valid_maildir(folder) {
+				err := create_maildir(folder)
+				if err != nil {
+					syslog_write(fmt.Sprintf("Could not create folder %s [%s]", folder, err.Error()))
+					continue
+				}
+			}
+			return folder
+		}
+
+		// Users can't send mail into other maildirs, only to their own
+		// folders, /dev/null, forwards and pipes
+		switch destination_type(rule.Destination) {
+		case "forward", "pipe":
+			return rule.Destination
+		case "maildir":
+			if rule.Destination == "/dev/null" {
+				return rule.Destination
+			}
+		}
+		syslog_write(fmt.Sprintf("Ignoring filter rule %d with destination %s, only folders, /dev/null, forwards and pipes are allowed", rule.Id, rule.Destination))
+	}
+
+	return ""
+}
+
+func filter_matches(rule filterrule, message email, sender string) bool {
+	expression := strings.Fields(rule.Expression)
+	if len(expression) != 2 {
+		debug(fmt.Sprintf("Invalid filter expression: %s\n", rule.Expression))
+		return false
+	}
+	field, operator := expression[0], strings.ToLower(expression[1])
+
+	var values []string
+	switch field {
+	case "SENDER":
+		if sender != "" {
+			values = []string{sender}
+		}
+	case "RECIPIENT":
+		values = []string{message.Recipient}
+	default:
+		values = header_values(message, field)
+	}
+
+	if operator == "exists" {
+		return len(values) > 0
+	}
+
+	for _, value := range values {
+		if match_operator(operator, value, rule.Value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func match_operator(operator string, value string, operand string) bool {
+	switch operator {
+	case "contains":
+		return strings.Contains(strings.ToLower(value), strings.ToLower(operand))
+	case "is":
+		return strings.EqualFold(value, operand)
+	case "begins":
+		return strings.HasPrefix(strings.ToLower(value), strings.ToLower(operand))
+	case "ends":
+		return strings.HasSuffix(strings.ToLower(value), strings.ToLower(operand))
+	case "matches":
+		re, err := regexp.Compile(operand)
+		if err != nil {
+			debug("Invalid regexp in filter rule: " + operand + "\n")
+			return false
+		}
+		return re.MatchString(value)
+	}
+
+	return false
+}
+
+func header_values(message email, key string) []string {
+	var result []string
+	decoder := new(mime.WordDecoder)
+
+	for _, value := range message.Header[textproto.CanonicalMIMEHeaderKey(key)] {
+		// Encoded words (RFC 2047) are decoded, so filters can match on plain text
+		decoded, err := decoder.DecodeHeader(value)
+		if err != nil {
+			decoded = value
+		}
+		result = append(result, decoded)
+	}
+
+	return result
+}
+
+func is_valid_folder(folder string) bool {
+	return strings.HasPrefix(folder, ".") &&
+		folder != "." &&
+		folder != ".." &&
+		!strings.Contains(folder, "/")
+}
+
+func create_maildir(dir string) error {
+	for _, subdir := range []string{"", "/cur", "/new", "/tmp"} {
+		err := os.Mkdir(dir+subdir, 0700)
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+
+	// Maildir++ marks subfolders with an empty `maildirfolder` file
+	marker, err := os.OpenFile(dir+"/maildirfolder", os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	return marker.Close()
+}
+
+func quota_exitcode() int {
+	// 111 (temporary failure) unless configured to bounce with 100
+	if chomp(file_content(configdir+"/quota_exitcode")) == "100" {
+		return 100
+	}
+	return 111
+}
+
+func maildir_root(directory string) string {
+	// Maildir++ folders (.Folder) live inside the top-level maildir
+	directory = path.Clean(directory)
+	if strings.HasPrefix(path.Base(directory), ".") {
+		return path.Dir(directory)
+	}
+	return directory
+}
+
+func maildirsize_usage(root string, limit int64) (int64, error) {
+	// See https://www.courier-mta.org/imap/README.maildirquota.html
+	// The first line holds the quota definition, every following line
+	// is a "<bytes> <messages>" delta. The file is recalculated if it is
+	// missing, the quota changed or it grew larger than 5120 bytes
+	content := file_content(root + "/maildirsize")
+	lines := strings.Split(chomp(content), "\n")
+
+	if content == "" ||
+		len(content) >= 5120 ||
+		maildirsize_limit(lines[0]) != limit {
+		debug("Recalculating maildirsize in " + root + "\n")
+		return maildirsize_recalculate(root, limit)
+	}
+
+	var usage int64
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return maildirsize_recalculate(root, limit)
+		}
+		usage += size
+	}
+
+	return usage, nil
+}
+
+func maildirsize_limit(definition string) int64 {
+	// The definition lists comma separated limits, e.g. "1000000S,1000C",
+	// only the size (S) is enforced here
+	for _, part := range strings.Split(strings.TrimSpace(definition), ",") {
+		if strings.HasSuffix(part, "S") {
+			size, err := strconv.ParseInt(strings.TrimSuffix(part, "S"), 10, 64)
+			if err == nil {
+				return size
+			}
+		}
+	}
+	return -1
+}
+
+func maildirsize_recalculate(root string, limit int64) (int64, error) {
+	filelist, err := directory_filelist_recursive(root)
+	if err != nil {
+		return 0, err
+	}
+
+	// Only messages count, which are in `cur` and `new` of every folder
+	var usage int64
+	var count int
+	for _, file := range filelist {
+		folder := path.Base(path.Dir(file))
+		if folder != "cur" && folder != "new" {
+			continue
+		}
+		if size := filesize(file); size > 0 {
+			usage += size
+			count++
+		}
+	}
+
+	// Write to `tmp` first, then rename, so readers never see a partial file
+	content := fmt.Sprintf("%dS\n%d %d\n", limit, usage, count)
+	tmpfile := root + "/tmp/maildirsize." + strconv.Itoa(os.Getpid())
+	err = os.WriteFile(tmpfile, []byte(content), 0600)
+	if err != nil {
+		return usage, err
+	}
+
+	return usage, os.Rename(tmpfile, root+"/maildirsize")
+}
+
+func maildirsize_update(root string, size int64) error {
+	file, err := os.OpenFile(root+"/maildirsize", os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	// A single write keeps the append atomic
+	_, err = file.WriteString(fmt.Sprintf("%d 1\n", size))
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func authentication_check(message email, sender string) ([]authres.Result, dmarc.Policy) {
+	var results []authres.Result
+
+	// DKIM is verified against the message as received
+	var verifications []*dkim.Verification
+	if spool, err := message.open(); err == nil {
+		verifications, err = dkim.Verify(spool)
+		spool.Close()
+		if err != nil {
+			debug("DKIM verification failed [" + err.Error() + "]\n")
+		}
+	}
+	if len(verifications) == 0 {
+		results = append(results, &authres.DKIMResult{Value: authres.ResultNone})
+	}
+	for _, verification := range verifications {
+		result := &authres.DKIMResult{Value: authres.ResultPass, Domain: verification.Domain, Identifier: verification.Identifier}
+		if verification.Err != nil {
+			result.Reason = verification.Err.Error()
+			switch {
+			case dkim.IsTempFail(verification.Err):
+				result.Value = authres.ResultTempError
+			case dkim.IsPermFail(verification.Err):
+				result.Value = authres.ResultPermError
+			default:
+				result.Value = authres.ResultFail
+			}
+		}
+		results = append(results, result)
+	}
+
+	// SPF is evaluated for the client that handed the message to us
+	spfresult := &authres.SPFResult{Value: authres.ResultNone, From: sender}
+	spfdomain := ""
+	ip, helo := received_client(message)
+	if ip != nil {
+		spfresult.Helo = helo
+		// Bounces are checked against the HELO identity
+		spfsender := sender
+		if spfsender == "" {
+			spfsender = "postmaster@" + helo
+		}
+		spfdomain = domain_part(spfsender)
+		result, err := spf.CheckHostWithSender(ip, helo, spfsender)
+		spfresult.Value = authres.ResultValue(result)
+		if err != nil {
+			spfresult.Reason = err.Error()
+		}
+		debug(fmt.Sprintf("SPF result for %s from %s: %s\n", spfsender, ip.String(), result))
+	}
+	results = append(results, spfresult)
+
+	dmarcresult, policy := dmarc_check(message, verifications, spfresult, spfdomain)
+	results = append(results, dmarcresult)
+
+	return results, policy
+}
+
+func dmarc_check(message email, verifications []*dkim.Verification, spfresult *authres.SPFResult, spfdomain string) (*authres.DMARCResult, dmarc.Policy) {
+	// DMARC requires exactly one From address
+	from, err := mail.ParseAddressList(message.Header.Get("From"))
+	if err != nil || len(from) != 1 {
+		return &authres.DMARCResult{Value: authres.ResultNone, Reason: "no single From address"}, ""
+	}
+	fromdomain := strings.ToLower(domain_part(from[0].Address))
+	result := &authres.DMARCResult{Value: authres.ResultNone, From: fromdomain}
+
+	// Without a record for the domain, the organizational domain is checked
+	record, err := dmarc.Lookup(fromdomain)
+	policy := dmarc.Policy("")
+	if err == dmarc.ErrNoPolicy {
+		orgdomain, orgerr := publicsuffix.EffectiveTLDPlusOne(fromdomain)
+		if orgerr == nil && orgdomain != fromdomain {
+			record, err = dmarc.Lookup(orgdomain)
+			if err == nil && record.SubdomainPolicy != "" {
+				policy = record.SubdomainPolicy
+			}
+		}
+	}
+	if err != nil {
+		if dmarc.IsTempFail(err) {
+			result.Value = authres.ResultTempError
+		}
+		return result, ""
+	}
+	if policy == "" {
+		policy = record.Policy
+	}
+
+	aligned := false
+	for _, verification := range verifications {
+		if verification.Err == nil && domains_aligned(fromdomain, verification.Domain, record.DKIMAlignment) {
+			aligned = true
+		}
+	}
+	if spfresult.Value == authres.ResultPass && domains_aligned(fromdomain, spfdomain, record.SPFAlignment) {
+		aligned = true
+	}
+
+	if aligned {
+		result.Value = authres.ResultPass
+		return result, ""
+	}
+
+	result.Value = authres.ResultFail
+	result.Reason = "p=" + string(policy)
+	return result, policy
+}
+
+func domains_aligned(fromdomain string, domain string, mode dmarc.AlignmentMode) bool {
+	fromdomain, domain = strings.ToLower(fromdomain), strings.ToLower(domain)
+	if domain == "" {
+		return false
+	}
+	if fromdomain == domain {
+		return true
+	}
+	if mode == dmarc.AlignmentStrict {
+		return false
+	}
+
+	// Relaxed alignment only needs the same organizational domain
+	orgfrom, err1 := publicsuffix.EffectiveTLDPlusOne(fromdomain)
+	orgdomain, err2 := publicsuffix.EffectiveTLDPlusOne(domain)
+	return err1 == nil && err2 == nil && orgfrom == orgdomain
+}
+
+func received_client(message email) (net.IP, string) {
+	// qmail-smtpd writes: from HOST (HELO NAME) (IP)
+	// Others write: from NAME (HOST [IP])
+	ipre := regexp.MustCompile(`[(\[]\s*(?:IPv6:)?([0-9a-fA-F:.]+)\s*[)\]]`)
+	helore := regexp.MustCompile(`\(HELO ([^)\s]+)\)`)
+	fromre := regexp.MustCompile(`^\s*from\s+([^\s(]+)`)
+
+	// Only headers added by us can be trusted, everything below is
+	// supplied by the sender. The topmost is ours, `trusted_hops` skips
+	// the ones our own relays added
+	hops := trusted_hops()
+	received := message.Header["Received"]
+	if len(received) <= hops {
+		return nil, ""
+	}
+
+	// Internal clients have no SPF, and we don't guess further down
+	match := ipre.FindStringSubmatch(received[hops])
+	if match == nil {
+		return nil, ""
+	}
+	ip := net.ParseIP(match[1])
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() {
+		return nil, ""
+	}
+
+	helo := ""
+	if match := helore.FindStringSubmatch(received[hops]); match != nil {
+		helo = match[1]
+	} else if match := fromre.FindStringSubmatch(received[hops]); match != nil {
+		helo = match[1]
+	}
+	return ip, helo
+}
+
+func trusted_hops() int {
+	// Number of own relays in front of this host (e.g. a separate MX),
+	// the client is then taken from the header the outermost relay wrote
+	hops, err := strconv.Atoi(chomp(file_content(configdir + "/trusted_hops")))
+	if err != nil || hops < 0 {
+		return 0
+	}
+	return hops
+}
+
+func is_own_authresult(value string, authserv string) bool {
+	// The authserv-id is everything up to the first semicolon
+	identifier := strings.Fields(strings.SplitN(value, ";", 2)[0])
+	return len(identifier) > 0 && strings.EqualFold(identifier[0], authserv)
+}
+
+func domain_part(address string) string {
+	return address[strings.LastIndex(address, "@")+1:]
+}
+
+func explain(step string, detail string) {
+	if explain_enabled {
+		explained = append(explained, explainstep{Step: step, Detail: detail})
+	}
+}
+
+func explain_finish(dreport report) {
+	if !explain_enabled {
+		return
+	}
+
+	if explain_json {
+		output, _ := json.MarshalIndent(struct {
+			Steps  []explainstep
+			Report report
+		}{explained, dreport}, "", "  ")
+		fmt.Println(string(output))
+		return
+	}
+
+	for _, step := range explained {
+		fmt.Printf("%-14s %s\n", step.Step, step.Detail)
+	}
+}
+
+func explain_features(dst destination) string {
+	var result []string
+	for _, feature := range []string{"antispam", "antivir", "attachfilter", "autoresponder", "dmarcreject", "dupfilter"} {
+		result = append(result, feature+"="+bool_yesno(dst.feature(feature)))
+	}
+	return strings.Join(result, " ")
+}
+
+func explain_verdicts(verdicts []verdict) {
+	for _, single := range verdicts {
+		switch {
+		case single.Error != "":
+			explain("scan", single.Scanner+": failed ["+single.Error+"]")
+		case single.Virus != "":
+			explain("scan", single.Scanner+": virus "+single.Virus)
+		default:
+			explain("scan", fmt.Sprintf("%s: score %.1f, spam %s", single.Scanner, single.Score, bool_yesno(single.Spam)))
+		}
+	}
+}
+
+func explain_action(dst destination, destination string, message email, sender string, dupfilter bool) string {
+	// Same order as the delivery loop, the last match wins
+	reason := "default"
+	if dst.Folder != "" {
+		reason = "extension folder"
+	}
+	if message.IsSpam || dst.IsSpam {
+		reason = "spam"
+	}
+	if dst.Filter != "" {
+		reason = "filter rule"
+	}
+
+	action := fmt.Sprintf("uid %d: %s %s (%s)", dst.Uid, destination_type(destination), destination, reason)
+	switch destination_type(destination) {
+	case "maildir":
+		if strings.HasPrefix(destination, "/dev/null") {
+			action += ", discarded"
+		} else if !is_valid_maildir(destination) {
+			action += ", not a valid maildir"
+		} else if dupfilter && message.Spool != "" && is_duplicate(destination, message) {
+			action += ", duplicate"
+		}
+	case "forward":
+		action += ", envelope sender <" + forward_envelope(sender) + ">, via " + get_transport().name()
+	}
+	return action
+}
+
+func stdin_is_message() bool {
+	// A terminal means nothing was piped in
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice == 0
+}
+
+func lmtp_recipient(dst destination, message email) string {
+	// The server knows the mailbox, not our aliases, wildcards or extensions
+	if dst.Username != "" {
+		return dst.Username
+	}
+	return message.Recipient
+}
+
+func lmtp_deliver(destination string, sender string, recipient string, message email) (int, error) {
+	// Everything after `lmtp:unix:` is the socket path, `lmtp:host:port` is TCP
+	network, address := "tcp", strings.TrimPrefix(destination, "lmtp:")
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+
+	conn, err := net.DialTimeout(network, address, 10*time.Second)
+	if err != nil {
+		return 111, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Minute))
+
+	input, err := message_reader(message)
+	if err != nil {
+		return 111, err
+	}
+	defer input.Close()
+
+	lmtp := textproto.NewConn(conn)
+	if _, _, err := lmtp.ReadResponse(220); err != nil {
+		return lmtp_exitcode(err), err
+	}
+
+	// A one-digit code accepts the whole class, e.g. 251 to RCPT
+	steps := []struct {
+		command string
+		code    int
+	}{
+		{"LHLO " + sys_hostname(), 2},
+		{"MAIL FROM:<" + sender + ">", 2},
+		{"RCPT TO:<" + recipient + ">", 2},
+		{"DATA", 354},
+	}
+	for _, step := range steps {
+		if err := lmtp.PrintfLine("%s", step.command); err != nil {
+			return 111, err
+		}
+		if _, _, err := lmtp.ReadResponse(step.code); err != nil {
+			lmtp.PrintfLine("QUIT")
+			return lmtp_exitcode(err), err
+		}
+	}
+
+	// DotWriter takes care of dot-stuffing and CRLF line endings
+	body := lmtp.DotWriter()
+	if _, err := io.Copy(body, input); err != nil {
+		return 111, err
+	}
+	if err := body.Close(); err != nil {
+		return 111, err
+	}
+
+	// LMTP replies once per recipient after DATA, we only have one
+	_, _, err = lmtp.ReadResponse(2)
+	lmtp.PrintfLine("QUIT")
+	if err != nil {
+		return lmtp_exitcode(err), err
+	}
+	return 0, nil
+}
+
+func lmtp_exitcode(err error) int {
+	reply, ok := err.(*textproto.Error)
+	if !ok {
+		return 111
+	}
+
+	// 5.2.2 is "mailbox full", which follows our own quota handling
+	if strings.HasPrefix(reply.Msg, "5.2.2") || strings.HasPrefix(reply.Msg, "4.2.2") {
+		return quota_exitcode()
+	}
+	if reply.Code >= 500 && reply.Code < 600 {
+		return 100
+	}
+	return 111
+}
+
+func message_reader(message email) (io.ReadCloser, error) {
+	// Modified messages come from the object, everything else from the spool
+	if message.UseObject && message.hasObject() {
+		// This has never failed so far, but we check anyway
+		objbytes, err := message.Object.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		return prepended(message, io.NopCloser(bytes.NewReader(objbytes))), nil
+	}
+
+	spool, err := message.open()
+	if err != nil {
+		return nil, err
+	}
+	if len(message.Edits) == 0 {
+		return prepended(message, spool), nil
+	}
+
+	header, body, err := edited(message, spool)
+	if err != nil {
+		spool.Close()
+		return nil, err
+	}
+	return prepended_reader{io.MultiReader(header, body), spool}, nil
+}
+
+func edited(message email, spool io.Reader) (io.Reader, io.Reader, error) {
+	// Only the header is rewritten, the body is copied byte for byte
+	input := bufio.NewReader(spool)
+	var header bytes.Buffer
+	header.WriteString(message.Prepend)
+	for _, edit := range message.Edits {
+		if edit.Value != "" {
+			header.WriteString(edit.Name + ": " + edit.Value + "\n")
+		}
+	}
+
+	// Fields are collected with their continuation lines before they are kept or dropped
+	var field []byte
+	flush := func() {
+		name, value, _ := strings.Cut(string(field), ":")
+		name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+		value = strings.Join(strings.Fields(value), " ")
+		for _, edit := range message.Edits {
+			if edit.Name == name && edit.Drop != nil && edit.Drop(value) {
+				field = nil
+				return
+			}
+		}
+		header.Write(field)
+		field = nil
+	}
+
+	for {
+		line, err := input.ReadBytes('\n')
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && field != nil {
+			field = append(field, line...)
+		} else if len(line) > 0 {
+			if field != nil {
+				flush()
+			}
+			// The empty line ends the header
+			if len(bytes.TrimRight(line, "\r\n")) == 0 {
+				header.Write(line)
+				break
+			}
+			field = append([]byte{}, line...)
+		}
+		if err == io.EOF {
+			if field != nil {
+				flush()
+			}
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return &header, input, nil
+}
+
+type prepended_reader struct {
+	io.Reader
+	io.Closer
+}
+
+func prepended(message email, input io.ReadCloser) io.ReadCloser {
+	if message.Prepend == "" {
+		return input
+	}
+	return prepended_reader{io.MultiReader(strings.NewReader(message.Prepend), input), input}
+}
+
+func new_scancache() *scancache {
+	return &scancache{scanners: get_scanners(), results: make(map[string]scanresult)}
+}
+
+func (c *scancache) scan(kind string, user string, message email, sender string) (verdict, []verdict, error) {
+	// Spam results depend on the user's preferences, so the user is part of the key
+	key := kind + " " + user
+	if result, ok := c.results[key]; ok {
+		return result.combined, result.verdicts, result.err
+	}
+
+	combined, verdicts, err := run_scanners(c.scanners, kind, message, sender, user)
+	c.results[key] = scanresult{combined: combined, verdicts: verdicts, err: err}
+	return combined, verdicts, err
+}
+
+func (c *scancache) authenticate(message email, sender string) ([]authres.Result, dmarc.Policy) {
+	if !c.authdone {
+		c.auth, c.policy = authentication_check(message, sender)
+		c.authdone = true
+	}
+	return c.auth, c.policy
+}
+
+func lmtp_listen(address string) {
+	// Same syntax as LMTP destinations, without the `lmtp:` prefix
+	network := "tcp"
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+		os.Remove(address)
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		fmt.Println("ERROR: Could not listen on " + address + " [" + err.Error() + "]")
+		return
+	}
+	defer listener.Close()
+	syslog_write(fmt.Sprintf("LMTP server listening on %s [version %s]", address, Version))
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Println("ERROR: Could not accept connection [" + err.Error() + "]")
+			continue
+		}
+		go lmtp_session(conn)
+	}
+}
+
+func lmtp_session(conn net.Conn) {
+	defer conn.Close()
+
+	// Generate a session ID to make log grep-ing easier
+	session := uuid.NewString()
+	syslog_write(fmt.Sprintf("%s / Starting LMTP session [version %s]", session, Version))
+
+	lmtp := textproto.NewConn(conn)
+	lmtp.PrintfLine("220 %s LMTP deliver ready", sys_hostname())
+
+	var sender string
+	var hassender bool
+	var recipients []recipient
+
+	for {
+		conn.SetDeadline(time.Now().Add(5 * time.Minute))
+		line, err := lmtp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, argument, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "LHLO":
+			lmtp.PrintfLine("250-%s\r\n250-PIPELINING\r\n250-ENHANCEDSTATUSCODES\r\n250-SIZE %d\r\n250 8BITMIME", sys_hostname(), lmtp_maxsize())
+
+		case "MAIL":
+			address, ok := lmtp_address(argument, "FROM:")
+			if !ok {
+				lmtp.PrintfLine("501 5.5.4 Syntax: MAIL FROM:<address>")
+				continue
+			}
+			// The SIZE parameter (RFC 1870) lets us refuse early
+			if lmtp_declared_size(argument) > lmtp_maxsize() {
+				lmtp.PrintfLine("552 5.3.4 Message size exceeds fixed limit")
+				continue
+			}
+			sender, hassender, recipients = address, true, nil
+			syslog_write(fmt.Sprintf("%s / Sender is <%s>", session, sender))
+			lmtp.PrintfLine("250 2.1.0 Ok")
+
+		case "RCPT":
+			address, ok := lmtp_address(argument, "TO:")
+			if !hassender || !ok || address == "" {
+				lmtp.PrintfLine("503 5.5.1 Need MAIL FROM and RCPT TO:<address>")
+				continue
+			}
+			if len(recipients) >= lmtp_maxrcpt() {
+				lmtp.PrintfLine("452 4.5.3 Too many recipients")
+				continue
+			}
+			syslog_write(fmt.Sprintf("%s / Recipient is <%s>", session, address))
+			exitcode, reason := recover_delivery(func() int {
+				recipients = append(recipients, resolve_recipient(session, address))
+				return 0
+			})
+			switch exitcode {
+			case 0:
+				lmtp.PrintfLine("250 2.1.5 Ok")
+			case 100:
+				lmtp.PrintfLine("550 5.1.1 %s", reason)
+			default:
+				lmtp.PrintfLine("451 4.3.0 %s", reason)
+			}
+
+		case "DATA":
+			if len(recipients) == 0 {
+				lmtp.PrintfLine("503 5.5.1 No valid recipients")
+				continue
+			}
+			lmtp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			if !lmtp_data(session, conn, lmtp, sender, recipients) {
+				return
+			}
+			hassender, recipients = false, nil
+
+		case "RSET":
+			hassender, recipients = false, nil
+			lmtp.PrintfLine("250 2.0.0 Ok")
+
+		case "NOOP":
+			lmtp.PrintfLine("250 2.0.0 Ok")
+
+		case "QUIT":
+			lmtp.PrintfLine("221 2.0.0 Bye")
+			return
+
+		default:
+			lmtp.PrintfLine("500 5.5.2 Unknown command")
+		}
+	}
+}
+
+func lmtp_data(session string, conn net.Conn, lmtp *textproto.Conn, sender string, recipients []recipient) bool {
+	start := time.Now()
+
+	// DotReader removes dot-stuffing and turns CRLF into LF, like qmail's files
+	// One byte more than allowed is read, so an oversized message is noticed
+	var message email
+	var err error
+	conn.SetDeadline(time.Now().Add(10 * time.Minute))
+	data := lmtp.DotReader()
+	maxsize := lmtp_maxsize()
+	message.Spool, message.Length, message.Sha1, err = spool_message(spool_directory(recipients[0].Destinations), "", io.LimitReader(data, maxsize+1))
+	if err != nil {
+		// The rest of the data can't be read reliably, so the session ends
+		syslog_write(fmt.Sprintf("%s / Could not spool message [%s]", session, err.Error()))
+		for range recipients {
+			lmtp.PrintfLine("451 4.3.0 Could not spool message")
+		}
+		return false
+	}
+	// Every recipient gets its own Delivered-To, so the spool is copied, not linked
+	defer os.Remove(message.Spool)
+
+	if int64(message.Length) > maxsize {
+		// The rest is read and thrown away, so the session stays usable
+		syslog_write(fmt.Sprintf("%s / Message exceeds %d bytes, rejected", session, maxsize))
+		if _, err := io.Copy(io.Discard, data); err != nil {
+			return false
+		}
+		for range recipients {
+			conn.SetDeadline(time.Now().Add(5 * time.Minute))
+			lmtp.PrintfLine("552 5.3.4 Message size exceeds fixed limit")
+		}
+		return true
+	}
+
+	syslog_write(fmt.Sprintf("%s / Read %d bytes via LMTP", session, message.Length))
+	message.Header = read_header(message)
+
+	// LMTP replies once per recipient, in the order of RCPT
+	cache := new_scancache()
+	for _, rcpt := range recipients {
+		message.Recipient = rcpt.Address
+		exitcode, reason := recover_delivery(func() int {
+			code, _ := process_message(session, start, message, sender, rcpt, cache)
+			return code
+		})
+		// Scanning and delivery may take longer than the client waits for one reply
+		conn.SetDeadline(time.Now().Add(5 * time.Minute))
+		switch {
+		case exitcode == 0:
+			lmtp.PrintfLine("250 2.0.0 <%s> Delivered", rcpt.Address)
+		case exitcode == 100:
+			lmtp.PrintfLine("550 5.0.0 <%s> Delivery failed %s", rcpt.Address, reason)
+		default:
+			lmtp.PrintfLine("451 4.0.0 <%s> Delivery deferred %s", rcpt.Address, reason)
+		}
+	}
+
+	return true
+}
+
+func lmtp_maxsize() int64 {
+	// Same as Postfix' default message_size_limit
+	size, err := strconv.ParseInt(chomp(file_content(configdir+"/lmtp_maxsize")), 10, 64)
+	if err != nil || size <= 0 {
+		return 10240000
+	}
+	return size
+}
+
+func lmtp_maxrcpt() int {
+	// RFC 5321 requires at least 100 recipients per transaction
+	count, err := strconv.Atoi(chomp(file_content(configdir + "/lmtp_maxrcpt")))
+	if err != nil || count <= 0 {
+		return 100
+	}
+	return count
+}
+
+func lmtp_declared_size(argument string) int64 {
+	for _, parameter := range strings.Fields(argument) {
+		if strings.HasPrefix(strings.ToUpper(parameter), "SIZE=") {
+			size, err := strconv.ParseInt(parameter[5:], 10, 64)
+			if err == nil {
+				return size
+			}
+		}
+	}
+	return 0
+}
+
+func lmtp_address(argument string, prefix string) (string, bool) {
+	// FROM:<address> [parameters], the parameters are ignored
+	if len(argument) < len(prefix) || !strings.EqualFold(argument[:len(prefix)], prefix) {
+		return "", false
+	}
+	path := strings.Fields(strings.TrimSpace(argument[len(prefix):]))
+	if len(path) == 0 || !strings.HasPrefix(path[0], "<") || !strings.HasSuffix(path[0], ">") {
+		return "", false
+	}
+	return strings.Trim(path[0], "<>"), true
+}
+
+func get_transport() transport {
+	fields := strings.Fields(chomp(file_content(configdir + "/transport")))
+	if len(fields) == 0 {
+		return qmailinject_transport{Path: "/var/qmail/bin/qmail-inject"}
+	}
+
+	switch fields[0] {
+	case "sendmail":
+		if len(fields) > 1 {
+			return sendmail_transport{Path: fields[1]}
+		}
+		return sendmail_transport{Path: "/usr/sbin/sendmail"}
+
+	case "smtp":
+		if len(fields) < 2 {
+			break
+		}
+		conf := smtp_transport{Address: fields[1], Timeout: 30 * time.Second}
+		for _, option := range fields[2:] {
+			key, value, _ := strings.Cut(option, "=")
+			switch key {
+			case "starttls":
+				conf.StartTLS = value == "yes"
+			case "user":
+				conf.User = value
+			case "password":
+				conf.Password = value
+			case "timeout":
+				if timeout, err := time.ParseDuration(value); err == nil {
+					conf.Timeout = timeout
+				}
+			}
+		}
+		return conf
+
+	case "qmail-inject":
+		if len(fields) > 1 {
+			return qmailinject_transport{Path: fields[1]}
+		}
+	default:
+		debug("Ignoring unknown transport type " + fields[0] + "\n")
+	}
+
+	return qmailinject_transport{Path: "/var/qmail/bin/qmail-inject"}
+}
+
+func forward_message(destination string, envelope string, message email) (int, error) {
+	input, err := message_reader(message)
+	if err != nil {
+		return 111, err
+	}
+	defer input.Close()
+
+	// Forwards keep Delivered-To, that's what detects the loop if they come back
+	return get_transport().send(envelope, []string{destination}, input)
+}
+
+func new_outbound(kind string, recipient string, result int, err error) outbound {
+	item := outbound{Kind: kind, Transport: get_transport().name(), Recipient: recipient, Result: result}
+	if err != nil {
+		item.Error = err.Error()
+	}
+	return item
+}
+
+func (t qmailinject_transport) send(sender string, recipients []string, input io.Reader) (int, error) {
+	// With recipients as arguments, qmail-inject ignores the header recipients
+	_, exitcode, err := sysexec(t.Path, append([]string{"-f", sender}, recipients...), input)
+	if err != nil && exitcode != 100 {
+		exitcode = 111
+	}
+	return exitcode, err
+}
+
+func (t sendmail_transport) send(sender string, recipients []string, input io.Reader) (int, error) {
+	// No -t, the envelope comes from the arguments, not the header
+	_, exitcode, err := sysexec(t.Path, append([]string{"-i", "-f", sender, "--"}, recipients...), input)
+	if err == nil {
+		return 0, nil
+	}
+
+	// sysexits.h: EX_DATAERR, EX_NOUSER and EX_NOHOST are permanent
+	switch exitcode {
+	case 65, 67, 68:
+		return 100, err
+	}
+	return 111, err
+}
+
+func (t smtp_transport) send(sender string, recipients []string, input io.Reader) (int, error) {
+	host, _, err := net.SplitHostPort(t.Address)
+	if err != nil {
+		return 111, err
+	}
+
+	conn, err := net.DialTimeout("tcp", t.Address, t.Timeout)
+	if err != nil {
+		return 111, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Minute))
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return smtp_exitcode(err), err
+	}
+	defer client.Close()
+
+	if err := client.Hello(sys_hostname()); err != nil {
+		return smtp_exitcode(err), err
+	}
+	if t.StartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return 111, errors.New(t.Address + " does not offer STARTTLS")
+		}
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return smtp_exitcode(err), err
+		}
+	}
+	// net/smtp refuses PLAIN without TLS, except to localhost
+	if t.User != "" {
+		if err := client.Auth(smtp.PlainAuth("", t.User, t.Password, host)); err != nil {
+			return smtp_exitcode(err), err
+		}
+	}
+
+	if err := client.Mail(sender); err != nil {
+		return smtp_exitcode(err), err
+	}
+	for _, recipient := range recipients {
+		if err := client.Rcpt(recipient); err != nil {
+			return smtp_exitcode(err), err
+		}
+	}
+
+	// The data writer takes care of dot-stuffing and CRLF line endings
+	body, err := client.Data()
+	if err != nil {
+		return smtp_exitcode(err), err
+	}
+	if _, err := io.Copy(body, input); err != nil {
+		return 111, err
+	}
+	if err := body.Close(); err != nil {
+		return smtp_exitcode(err), err
+	}
+
+	client.Quit()
+	return 0, nil
+}
+
+func smtp_exitcode(err error) int {
+	// Unlike LMTP, a full remote mailbox is not our quota
+	if reply, ok := err.(*textproto.Error); ok && reply.Code >= 500 && reply.Code < 600 {
+		return 100
+	}
+	return 111
+}
+
+func clean_message(message email, sender string, token string) (string, []removedpart, error) {
+	var removed []removedpart
+
+	// The message is held in memory, like the object used to be
+	if message.Length > mimescan_limit() {
+		return "", nil, errors.New("message too large")
+	}
+	content, err := message.read()
+	if err != nil {
+		return "", nil, err
+	}
+	header, body := split_message(content)
+
+	if !is_multipart(textproto.MIMEHeader(message.Header)) {
+		return "", nil, nil
+	}
+
+	var scanners []scanner
+	for _, single := range get_scanners() {
+		if single.kind() == "virus" {
+			scanners = append(scanners, single)
+		}
+	}
+
+	var scanerr error
+	cleaned := walk_mime(textproto.MIMEHeader(message.Header), body, "", func(part string, partheader textproto.MIMEHeader, partbody []byte) []byte {
+		if scanerr != nil {
+			return nil
+		}
+		virus, err := scan_part(scanners, filepath.Dir(message.Spool), partheader, partbody, sender)
+		if err != nil {
+			scanerr = err
+			return nil
+		}
+		if virus == "" {
+			return nil
+		}
+
+		item := removedpart{Part: part, ContentType: partheader.Get("Content-Type"), Filename: part_filename(partheader), Virus: virus}
+		removed = append(removed, item)
+		// The placeholder follows the line endings of the message
+		if bytes.Contains(content, []byte("\r\n")) {
+			return bytes.ReplaceAll(placeholder_part(item, token), []byte("\n"), []byte("\r\n"))
+		}
+		return placeholder_part(item, token)
+	})
+	if scanerr != nil || len(removed) == 0 {
+		return "", nil, scanerr
+	}
+
+	output, err := os.CreateTemp(filepath.Dir(message.Spool), "clean")
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = output.Write(append(header, cleaned...))
+	if cerr := output.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(output.Name())
+		return "", nil, err
+	}
+
+	return output.Name(), removed, nil
+}
+
+func mimescan_limit() int {
+	// Messages larger than this (in bytes) are quarantined as a whole
+	limit, err := strconv.Atoi(chomp(file_content(configdir + "/mimescan_limit")))
+	if err != nil || limit <= 0 {
+		return 10485760
+	}
+	return limit
+}
+
+func split_message(content []byte) ([]byte, []byte) {
+	// The header includes the empty line, so joining both gives the original
+	for n := 0; n < len(content); n++ {
+		if n > 0 && content[n-1] != '\n' {
+			continue
+		}
+		if bytes.HasPrefix(content[n:], []byte("\n")) {
+			return content[:n+1], content[n+1:]
+		}
+		if bytes.HasPrefix(content[n:], []byte("\r\n")) {
+			return content[:n+2], content[n+2:]
+		}
+	}
+	return content, nil
+}
+
+func is_multipart(header textproto.MIMEHeader) bool {
+	mediatype, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && strings.HasPrefix(mediatype, "multipart/") && params["boundary"] != ""
+}
+
+func is_attached_message(header textproto.MIMEHeader) bool {
+	// Encoded attached messages are not allowed (RFC 2046), they stay leaves
+	mediatype, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "", "7bit", "8bit", "binary":
+		return err == nil && mediatype == "message/rfc822"
+	}
+	return false
+}
+
+func walk_mime(header textproto.MIMEHeader, body []byte, part string, replace func(string, textproto.MIMEHeader, []byte) []byte) []byte {
+	_, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	delimiter := []byte("--" + params["boundary"])
+
+	// Everything outside the parts (preamble, delimiters, epilogue) is kept as-is
+	var result []byte
+	var current []byte
+	inpart := false
+	number := 0
+	finish := func() {
+		defer func() { current = nil }()
+		if !inpart {
+			result = append(result, current...)
+			return
+		}
+
+		number++
+		subpart := strconv.Itoa(number)
+		if part != "" {
+			subpart = part + "." + subpart
+		}
+		partheader, partbody := split_message(current)
+		parsed, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(partheader))).ReadMIMEHeader()
+		if parsed == nil {
+			parsed = textproto.MIMEHeader{}
+		}
+
+		if is_multipart(parsed) {
+			result = append(result, partheader...)
+			result = append(result, walk_mime(parsed, partbody, subpart, replace)...)
+		} else if replacement := replace(subpart, parsed, partbody); replacement != nil {
+			// Leaves are replaced including their header
+			result = append(result, replacement...)
+		} else if is_attached_message(parsed) {
+			// Attached messages are walked too, numbered like IMAP (2.1, 2.2, ...)
+			innerheader, innerbody := split_message(partbody)
+			innerparsed, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(innerheader))).ReadMIMEHeader()
+			if innerparsed == nil {
+				innerparsed = textproto.MIMEHeader{}
+			}
+			result = append(result, partheader...)
+			if is_multipart(innerparsed) {
+				result = append(result, innerheader...)
+				result = append(result, walk_mime(innerparsed, innerbody, subpart, replace)...)
+			} else if replacement := replace(subpart+".1", innerparsed, innerbody); replacement != nil {
+				result = append(result, replacement...)
+			} else {
+				result = append(result, partbody...)
+			}
+		} else {
+			result = append(result, current...)
+		}
+	}
+
+	closed := false
+	for len(body) > 0 {
+		end := bytes.IndexByte(body, '\n')
+		if end < 0 {
+			end = len(body) - 1
+		}
+		line := body[:end+1]
+		body = body[end+1:]
+
+		trimmed := bytes.TrimRight(line, " \t\r\n")
+		if !closed && bytes.HasPrefix(trimmed, delimiter) {
+			rest := trimmed[len(delimiter):]
+			if len(rest) == 0 || bytes.Equal(rest, []byte("--")) {
+				// The line break before a delimiter belongs to the delimiter
+				var linebreak []byte
+				if inpart && bytes.HasSuffix(current, []byte("\r\n")) {
+					linebreak = []byte("\r\n")
+				} else if inpart && bytes.HasSuffix(current, []byte("\n")) {
+					linebreak = []byte("\n")
+				}
+				current = current[:len(current)-len(linebreak)]
+				finish()
+				result = append(result, linebreak...)
+				result = append(result, line...)
+				inpart = len(rest) == 0
+				closed = !inpart
+				continue
+			}
+		}
+		current = append(current, line...)
+	}
+	// Unterminated multiparts keep their last part
+	finish()
+
+	return result
+}
+
+func scan_part(scanners []scanner, directory string, header textproto.MIMEHeader, body []byte, sender string) (string, error) {
+	// Parts are scanned decoded, that's what the user would open
+	decoded, err := io.ReadAll(transfer_decoder(header.Get("Content-Transfer-Encoding"), bytes.NewReader(body)))
+	if err != nil {
+		decoded = body
+	}
+
+	file, err := os.CreateTemp(directory, "part")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(decoded)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	result, _, err := run_scanners(scanners, "virus", email{Spool: file.Name(), Length: len(decoded)}, sender, "")
+	if err != nil {
+		return "", err
+	}
+	return result.Virus, nil
+}
+
+func transfer_decoder(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+func part_filename(header textproto.MIMEHeader) string {
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil {
+		return params["name"]
+	}
+	return ""
+}
+
+func placeholder_part(item removedpart, token string) []byte {
+	name := item.Filename
+	if name == "" {
+		name = "part " + item.Part
+	}
+	return []byte("Content-Type: text/plain; charset=utf-8\n" +
+		"Content-Transfer-Encoding: 8bit\n" +
+		"Content-Disposition: inline\n" +
+		"\n" +
+		"The attachment " + name + " was removed because it contains a virus.\n\n" +
+		"Virus:   " + item.Virus + "\n" +
+		"Type:    " + item.ContentType + "\n\n" +
+		"If you believe this is a mistake, contact your administrator\n" +
+		"and quote the following release token:\n\n" +
+		"    " + token)
+}
+
+func get_attachrules(domain string) []attachrule {
+	var result []attachrule
+
+	debug("Running query in get_attachrules\n")
+	rows, err := db.Query("SELECT kind, value, action FROM attachpolicy WHERE domain = ? OR domain = '*' ORDER BY id", domain)
+	if err != nil {
+		exit_delivery(111, "ERROR: "+err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rule attachrule
+		if err := rows.Scan(&rule.Kind, &rule.Value, &rule.Action); err != nil {
+			exit_delivery(111, "ERROR: "+err.Error())
+		}
+		result = append(result, rule)
+	}
+	return result
+}
+
+func attachment_check(message email, rules []attachrule) ([]attachfinding, error) {
+	var findings []attachfinding
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	// Same limit as for MIME part scanning, the message is held in memory
+	if message.Length > mimescan_limit() {
+		return nil, errors.New("message too large")
+	}
+	content, err := message.read()
+	if err != nil {
+		return nil, err
+	}
+	_, body := split_message(content)
+
+	var files []attachment
+	collect := func(part string, header textproto.MIMEHeader, partbody []byte) []byte {
+		decoded, err := io.ReadAll(transfer_decoder(header.Get("Content-Transfer-Encoding"), bytes.NewReader(partbody)))
+		if err != nil {
+			decoded = partbody
+		}
+		declared, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+		budget := int64(mimescan_limit())
+		files = append(files, inspect_file(part, part_filename(header), declared, decoded, 0, &budget)...)
+		return nil
+	}
+
+	header := textproto.MIMEHeader(message.Header)
+	if is_multipart(header) {
+		walk_mime(header, body, "", collect)
+	} else {
+		collect("1", header, body)
+	}
+
+	for _, file := range files {
+		for _, rule := range rules {
+			if attachrule_matches(rule, file) {
+				// Every match is recorded, so `block` is not hidden by an earlier `quarantine`
+				findings = append(findings, attachfinding{Part: file.Part, Name: file.Name, Rule: rule.Kind + ":" + rule.Value, Action: rule.Action})
+			}
+		}
+	}
+	return findings, nil
+}
+
+func attachment_action(findings []attachfinding) (string, string) {
+	// `block` wins over `quarantine`
+	var action, reason string
+	for _, finding := range findings {
+		if finding.Action == "block" || action == "" {
+			action, reason = finding.Action, finding.Rule+" "+finding.Name
+		}
+		if action == "block" {
+			break
+		}
+	}
+	return action, reason
+}
+
+// Extensions Windows runs (or hands to a script host) on a double click
+var executable_extensions = map[string]bool{
+	"exe": true, "scr": true, "com": true, "pif": true, "bat": true, "cmd": true,
+	"js": true, "jse": true, "vbs": true, "vbe": true, "wsf": true, "wsh": true,
+	"hta": true, "jar": true, "msi": true, "ps1": true, "lnk": true, "cpl": true,
+}
+
+func inspect_file(part string, name string, declared string, data []byte, depth int, budget *int64) []attachment {
+	file := attachment{Part: part, Name: name, Declared: declared, Sniffed: sniff_type(data)}
+	file.Macro = has_macros(file.Sniffed, data)
+	result := []attachment{file}
+
+	// Archives in archives are followed, but not forever
+	if depth >= 2 {
+		return result
+	}
+
+	switch file.Sniffed {
+	case "application/zip":
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return result
+		}
+		for _, member := range archive.File {
+			if member.FileInfo().IsDir() {
+				continue
+			}
+			membername := name + "/" + member.Name
+			// Bit 0 of the flags marks an encrypted member, its content can't be read
+			if member.Flags&0x1 != 0 {
+				result[0].Encrypted = true
+				result = append(result, attachment{Part: part, Name: membername, Encrypted: true})
+				continue
+			}
+			if strings.HasSuffix(member.Name, "vbaProject.bin") {
+				result[0].Macro = true
+			}
+			result = append(result, inspect_file(part, membername, "", read_member(member, budget), depth+1, budget)...)
+		}
+
+	case "application/gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return result
+		}
+		result = append(result, inspect_file(part, strings.TrimSuffix(name, ".gz"), "", inflate(reader, budget), depth+1, budget)...)
+
+	case "application/x-tar":
+		archive := tar.NewReader(bytes.NewReader(data))
+		for {
+			member, err := archive.Next()
+			if err != nil {
+				break
+			}
+			if member.Typeflag != tar.TypeReg {
+				continue
+			}
+			result = append(result, inspect_file(part, name+"/"+member.Name, "", inflate(archive, budget), depth+1, budget)...)
+		}
+	}
+
+	return result
+}
+
+func read_member(member *zip.File, budget *int64) []byte {
+	reader, err := member.Open()
+	if err != nil {
+		return nil
+	}
+	defer reader.Close()
+	return inflate(reader, budget)
+}
+
+func inflate(reader io.Reader, budget *int64) []byte {
+	// Zip bombs inflate far beyond the message size, so everything unpacked
+	// from one attachment shares `mimescan_limit`. Once it is used up,
+	// members are still checked by name
+	content, _ := io.ReadAll(io.LimitReader(reader, *budget))
+	*budget -= int64(len(content))
+	return content
+}
+
+func sniff_type(data []byte) string {
+	// http.DetectContentType doesn't know executables and Office containers
+	switch {
+	case bytes.HasPrefix(data, []byte("MZ")):
+		return "application/x-msdownload"
+	case bytes.HasPrefix(data, []byte("\x7fELF")):
+		return "application/x-executable"
+	case bytes.HasPrefix(data, []byte("#!")):
+		return "text/x-shellscript"
+	case bytes.HasPrefix(data, []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1")):
+		return "application/x-ole-storage"
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		return "application/zip"
+	case bytes.HasPrefix(data, []byte("\x1f\x8b")):
+		return "application/gzip"
+	case len(data) > 262 && string(data[257:262]) == "ustar":
+		return "application/x-tar"
+	}
+	mediatype, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	return mediatype
+}
+
+func has_macros(sniffed string, data []byte) bool {
+	// Legacy Office files keep VBA in an OLE stream named _VBA_PROJECT (UTF-16)
+	if sniffed == "application/x-ole-storage" {
+		return bytes.Contains(data, []byte("_\x00V\x00B\x00A\x00_\x00P\x00R\x00O\x00J\x00E\x00C\x00T\x00"))
+	}
+	return false
+}
+
+func attachrule_matches(rule attachrule, file attachment) bool {
+	name := strings.ToLower(strings.TrimSpace(file.Name))
+	switch rule.Kind {
+	case "extension":
+		return strings.HasSuffix(name, "."+strings.ToLower(strings.TrimPrefix(rule.Value, ".")))
+	case "type":
+		for _, mediatype := range []string{file.Declared, file.Sniffed} {
+			pattern := strings.ToLower(rule.Value)
+			if mediatype == "" {
+				continue
+			}
+			if mediatype == pattern || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(mediatype, strings.TrimSuffix(pattern, "*"))) {
+				return true
+			}
+		}
+	case "double":
+		return double_extension(name)
+	case "macro":
+		return file.Macro
+	case "encrypted":
+		return file.Encrypted
+	}
+	return false
+}
+
+func double_extension(name string) bool {
+	// A document extension followed by an executable one, e.g. invoice.pdf.exe
+	// Compressed documents (report.pdf.zip, server.log.txt.gz) are fine
+	parts := strings.Split(path.Base(name), ".")
+	if len(parts) < 3 {
+		return false
+	}
+	switch parts[len(parts)-2] {
+	case "pdf", "doc", "docx", "xls", "xlsx", "ppt", "pptx", "rtf", "txt", "jpg", "jpeg", "png", "gif":
+		return executable_extensions[parts[len(parts)-1]]
+	}
+	return false
+}
@@ -1,6 +1,6 @@
 module github.com/stevemeier/qbox
 
-go 1.16
+go 1.23.0
 
 require (
 	blitiri.com.ar/go/spf v1.3.0
@@ -16,12 +16,41 @@ require (
 	github.com/jmoiron/sqlx v1.3.5
 	github.com/jordan-wright/email v4.0.1-0.20210109023952-943e75fe5223+incompatible
 	github.com/mattn/go-sqlite3 v1.14.10
-	github.com/oschwald/geoip2-golang v1.9.0 // indirect
-	github.com/pkg/errors v0.9.1 // indirect
+	github.com/oschwald/geoip2-golang v1.9.0
 	github.com/teamwork/spamc v0.0.0-20200109085853-a4e0c5c3f7a0
-	github.com/teamwork/test v0.0.0-20200108114543-02621bae84ad // indirect
-	github.com/teamwork/utils v0.0.0-20211112162623-194b7eff720f // indirect
 	github.com/valyala/fasthttp v1.44.0
 	golang.org/x/net v0.38.0
-	golang.org/x/sys v0.28.0
+	golang.org/x/sys v0.31.0
+)
+
+require (
+	github.com/Strum355/go-difflib v1.1.0 // indirect
+	github.com/andybalholm/brotli v1.0.4 // indirect
+	github.com/emersion/go-msgauth v0.7.0
+	github.com/google/go-cmp v0.6.0 // indirect
+	github.com/klauspost/compress v1.15.9 // indirect
+	github.com/lib/pq v1.2.0 // indirect
+	github.com/oschwald/maxminddb-golang v1.11.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/savsgio/gotils v0.0.0-20220530130905-52f3993e8d6d // indirect
+	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/stretchr/objx v0.5.0 // indirect
+	github.com/stretchr/testify v1.8.4 // indirect
+	github.com/teamwork/test v0.0.0-20200108114543-02621bae84ad // indirect
+	github.com/teamwork/utils v0.0.0-20211112162623-194b7eff720f // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	github.com/valyala/tcplisten v1.0.0 // indirect
+	github.com/yuin/goldmark v1.4.13 // indirect
+	golang.org/x/crypto v0.36.0 // indirect
+	golang.org/x/mod v0.17.0 // indirect
+	golang.org/x/sync v0.12.0 // indirect
+	golang.org/x/telemetry v0.0.0-20240228155512-f48c80bd79b2 // indirect
+	golang.org/x/term v0.30.0 // indirect
+	golang.org/x/text v0.23.0 // indirect
+	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
+	golang.org/x/xerrors v0.0.0-20190717185122-a985d3407aa7 // indirect
+	gopkg.in/check.v1 v0.0.0-20161208181325-20d25e280405 // indirect
+	gopkg.in/yaml.v2 v2.3.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
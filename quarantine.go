@@ -0,0 +1,205 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "strings"
+import "time"
+
+import "github.com/google/uuid"
+
+const configdir = "/etc/qbox"
+
+// Manages messages quarantined by `deliver`
+//
+// quarantine list
+// quarantine release TOKEN
+// quarantine purge TOKEN
+// quarantine purge --older-than DAYS
+
+// Exit codes
+// 0 = success
+// 1 = usage error or unknown token
+// 2 = quarantine could not be read or modified
+// Released messages exit with the exit code of `deliver`
+
+// Metadata stored next to each quarantined message
+type quarantined struct {
+	Token     string
+	Virus     string
+	Sender    string
+	Recipient string
+	Sha1      string
+	Size      int
+	Time      int64
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "list":
+		items, err := quarantine_items()
+		if err != nil {
+			fmt.Println("ERROR: Could not read quarantine [" + err.Error() + "]")
+			os.Exit(2)
+		}
+		for _, item := range items {
+			fmt.Printf("%s\t%s\t%s\t<%s>\t<%s>\t%d\n", item.Token, time.Unix(item.Time, 0).Format("2006-01-02 15:04:05"), item.Virus, item.Sender, item.Recipient, item.Size)
+		}
+	case "release":
+		if len(os.Args) != 3 {
+			usage()
+		}
+		os.Exit(release(os.Args[2]))
+	case "purge":
+		if len(os.Args) == 4 && os.Args[2] == "--older-than" {
+			days, err := strconv.Atoi(os.Args[3])
+			if err != nil || days < 0 {
+				usage()
+			}
+			os.Exit(purge_older(time.Now().Add(-time.Duration(days) * 24 * time.Hour)))
+		}
+		if len(os.Args) != 3 {
+			usage()
+		}
+		item := quarantine_item(os.Args[2])
+		os.Exit(purge(item))
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " list | release TOKEN | purge TOKEN | purge --older-than DAYS")
+	os.Exit(1)
+}
+
+func release(token string) int {
+	item := quarantine_item(token)
+
+	// `deliver` skips the virus scan for valid release tokens
+	executable, err := os.Executable()
+	if err != nil {
+		fmt.Println("ERROR: Could not locate deliver [" + err.Error() + "]")
+		return 2
+	}
+	input, err := os.Open(quarantine_directory() + "/" + item.Token + ".eml")
+	if err != nil {
+		fmt.Println("ERROR: Could not open message [" + err.Error() + "]")
+		return 2
+	}
+	defer input.Close()
+
+	cmd := exec.Command(filepath.Join(filepath.Dir(executable), "deliver"))
+	cmd.Env = append(os.Environ(), "RECIPIENT="+item.Recipient, "SENDER="+item.Sender, "QBOX_RELEASE="+item.Token)
+	cmd.Stdin = input
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			fmt.Println("ERROR: deliver failed for " + item.Token + " [" + err.Error() + "]")
+			return exitErr.ExitCode()
+		}
+		fmt.Println("ERROR: Could not run deliver [" + err.Error() + "]")
+		return 2
+	}
+
+	fmt.Println("Released " + item.Token + " to <" + item.Recipient + ">")
+	return purge(item)
+}
+
+func purge(item quarantined) int {
+	directory := quarantine_directory()
+	for _, suffix := range []string{".eml", ".json"} {
+		err := os.Remove(directory + "/" + item.Token + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Println("ERROR: Could not remove " + item.Token + suffix + " [" + err.Error() + "]")
+			return 2
+		}
+	}
+	fmt.Println("Purged " + item.Token)
+	return 0
+}
+
+func purge_older(before time.Time) int {
+	items, err := quarantine_items()
+	if err != nil {
+		fmt.Println("ERROR: Could not read quarantine [" + err.Error() + "]")
+		return 2
+	}
+
+	exitcode := 0
+	for _, item := range items {
+		if item.Time < before.Unix() {
+			if purge(item) != 0 {
+				exitcode = 2
+			}
+		}
+	}
+	return exitcode
+}
+
+func quarantine_item(token string) quarantined {
+	var item quarantined
+
+	// Tokens are UUIDs, anything else could escape the quarantine directory
+	_, err := uuid.Parse(token)
+	if err == nil {
+		err = json.Unmarshal([]byte(file_content(quarantine_directory()+"/"+token+".json")), &item)
+	}
+	if err != nil || item.Token != token {
+		fmt.Println("ERROR: Unknown token " + token)
+		os.Exit(1)
+	}
+
+	return item
+}
+
+func quarantine_items() ([]quarantined, error) {
+	files, err := filepath.Glob(quarantine_directory() + "/*.json")
+	if err != nil {
+		return nil, err
+	}
+
+	var items []quarantined
+	for _, file := range files {
+		var item quarantined
+		if json.Unmarshal([]byte(file_content(file)), &item) != nil ||
+			item.Token != strings.TrimSuffix(filepath.Base(file), ".json") {
+			fmt.Fprintln(os.Stderr, "Skipping invalid metadata "+file)
+			continue
+		}
+		items = append(items, item)
+	}
+
+	// Oldest first
+	sort.Slice(items, func(i, j int) bool { return items[i].Time < items[j].Time })
+	return items, nil
+}
+
+func quarantine_directory() string {
+	if _, err := os.Stat(configdir + "/quarantine"); err == nil {
+		return chomp(file_content(configdir + "/quarantine"))
+	}
+	return "/var/qmail/quarantine"
+}
+
+func file_content(filename string) string {
+	buf, err := os.ReadFile(filename)
+	if err == nil {
+		return string(buf)
+	}
+	return ""
+}
+
+func chomp(s string) string {
+	return strings.TrimRight(s, "\n")
+}
@@ -10,6 +10,13 @@ import "strings"
 
 const configdir = "/etc/qbox"
 
+// Addresses of accounts outside their `open`/`close` lifetime are unknown, as in `deliver`
+const account_active = "(passwd.open = 0 OR passwd.open <= UNIX_TIMESTAMP()) AND (passwd.close = 0 OR passwd.close > UNIX_TIMESTAMP())"
+
+// Picks the rows `deliver` uses: the user's own mapping, the wildcard only
+// if there is no active one. Takes the parameters domain, user, user
+const own_or_wildcard = "user = IF(EXISTS(SELECT 1 FROM mapping AS own INNER JOIN passwd ON passwd.uid = own.uid WHERE own.domain = ? AND own.user = ? AND " + account_active + "), ?, '*')"
+
 func main() {
 	// No SMTPRCPTTO, we can't do anything
 	if !env_defined("SMTPRCPTTO") {
@@ -33,13 +40,14 @@ func main() {
 	user, domain := addrparts[0], addrparts[1]
 
 	// 20220403: Support extensions
-	user = remove_extension(user)
+	var extension string
+	user, extension = split_extension(user, extension_delimiter())
 
-	_ = verify_recipient(smtprcptto, user, domain)
+	_ = verify_recipient(smtprcptto, user, extension, domain)
 	os.Exit(0)
 }
 
-func verify_recipient (smtprcptto string, user string, domain string) (bool) {
+func verify_recipient (smtprcptto string, user string, extension string, domain string) (bool) {
 	// Read config files
 	var dbserver string = "127.0.0.1"
 	if fileExists(configdir + "/dbserver") {
@@ -107,7 +115,7 @@ func verify_recipient (smtprcptto string, user string, domain string) (bool) {
 	}
 
 	// Query DB for user
-	stmt2, err := db.Prepare("SELECT DISTINCT COUNT(passwd.homedir) FROM passwd INNER JOIN mapping ON passwd.uid = mapping.uid WHERE domain = ? AND (user = ? OR user = '*')")
+	stmt2, err := db.Prepare("SELECT DISTINCT COUNT(passwd.homedir) FROM passwd INNER JOIN mapping ON passwd.uid = mapping.uid WHERE domain = ? AND (user = ? OR user = '*') AND " + account_active)
 	if err != nil {
 		internal_error()
 		log.Fatal(err)
@@ -128,6 +136,59 @@ func verify_recipient (smtprcptto string, user string, domain string) (bool) {
 		}
 	}
 
+	// Users can disable extension addresses (passwd.extensions = 0)
+	if ucount > 0 && len(extension) > 0 {
+		stmt4, err := db.Prepare("SELECT COUNT(passwd.uid) FROM passwd INNER JOIN mapping ON passwd.uid = mapping.uid WHERE domain = ? AND " +
+			own_or_wildcard + " AND extensions > 0 AND " + account_active)
+		if err != nil {
+			internal_error()
+			log.Fatal(err)
+		}
+		defer stmt4.Close()
+
+		var ecount int
+		err = stmt4.QueryRow(domain, domain, user, user).Scan(&ecount)
+		if err != nil {
+			internal_error()
+			log.Fatal(err)
+		}
+
+		if ecount == 0 {
+			fmt.Fprintf(os.Stderr, "%d Extension addresses are disabled for %s\n", os.Getppid(), smtprcptto)
+			fmt.Fprintf(os.Stdout, "E550 User unknown [%s]\n", smtprcptto)
+			return false
+		}
+	}
+
+	// Locked accounts are handled according to `locked_policy`
+	// A locked user is not rescued by an unlocked wildcard, `deliver` would bounce
+	if ucount > 0 && locked_policy() != "deliver" {
+		stmt5, err := db.Prepare("SELECT COUNT(passwd.uid) FROM passwd INNER JOIN mapping ON passwd.uid = mapping.uid WHERE domain = ? AND " +
+			own_or_wildcard + " AND locked = 0 AND " + account_active)
+		if err != nil {
+			internal_error()
+			log.Fatal(err)
+		}
+		defer stmt5.Close()
+
+		var lcount int
+		err = stmt5.QueryRow(domain, domain, user, user).Scan(&lcount)
+		if err != nil {
+			internal_error()
+			log.Fatal(err)
+		}
+
+		if lcount == 0 {
+			fmt.Fprintf(os.Stderr, "%d Account for %s is locked\n", os.Getppid(), smtprcptto)
+			if locked_policy() == "defer" {
+				fmt.Fprintf(os.Stdout, "E451 Mailbox temporarily unavailable [%s]\n", smtprcptto)
+			} else {
+				fmt.Fprintf(os.Stdout, "E550 Mailbox disabled [%s]\n", smtprcptto)
+			}
+			return false
+		}
+	}
+
 	if ucount > 0 {
 		// Recipient found
 		fmt.Fprintf(os.Stderr, "%d Found mapping for %s\n", os.Getppid(), smtprcptto)
@@ -180,10 +241,30 @@ func internal_error() {
 	fmt.Println("E451 Recipient verification falied")
 }
 
-func remove_extension (s string) (string) {
+func split_extension (s string, delimiter string) (string, string) {
 	// https://stackoverflow.com/a/29581738
-	if idx := strings.Index(s, "+"); idx != -1 {
-		return s[:idx]
+	if idx := strings.Index(s, delimiter); idx != -1 {
+		return s[:idx], s[idx+len(delimiter):]
+	}
+	return s, ""
+}
+
+func extension_delimiter () (string) {
+	buf, err := ioutil.ReadFile(configdir + "/extension_delimiter")
+	if err == nil && len(strings.TrimSpace(string(buf))) > 0 {
+		return strings.TrimSpace(string(buf))
+	}
+	return "+"
+}
+
+func locked_policy () (string) {
+	// `defer`, `bounce` or `deliver` (logins are still refused)
+	buf, err := ioutil.ReadFile(configdir + "/locked_policy")
+	if err == nil {
+		switch strings.TrimSpace(string(buf)) {
+		case "defer", "bounce":
+			return strings.TrimSpace(string(buf))
+		}
 	}
-	return s
+	return "deliver"
 }
@@ -0,0 +1,239 @@
+package main
+
+import "database/sql"
+import _ "github.com/go-sql-driver/mysql"
+import "errors"
+import "fmt"
+import "os"
+import "regexp"
+import "strconv"
+import "strings"
+
+const configdir = "/etc/qbox"
+
+// Manages per-user SpamAssassin preferences in `userpref`
+//
+// spamprefs list USER
+// spamprefs set USER required_score SCORE
+// spamprefs set USER score RULE SCORE
+// spamprefs add USER whitelist_from|blacklist_from|welcomelist_from|blocklist_from ADDRESS
+// spamprefs del USER PREFERENCE [VALUE]
+//
+// USER is a `passwd.username` (what `deliver` passes to spamd) or @GLOBAL.
+// The table has SpamAssassin's default layout, so spamd reads it with
+// user_scores_dsn and user_scores_sql_custom_query, e.g.
+// SELECT preference, value FROM userpref WHERE username = _USERNAME_ OR username = '@GLOBAL' ORDER BY username ASC
+
+// Exit codes
+// 0 = success
+// 1 = usage error or unknown user
+// 2 = database problem
+
+var db *sql.DB
+
+// Preferences with more than one value per user
+var listprefs = map[string]bool{
+	"whitelist_from":   true,
+	"blacklist_from":   true,
+	"welcomelist_from": true,
+	"blocklist_from":   true,
+}
+
+var rulename = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+func main() {
+	if len(os.Args) < 3 {
+		usage()
+	}
+
+	// Read config files
+	var dbserver string = "127.0.0.1"
+	if file_exists(configdir + "/dbserver") {
+		dbserver = chomp(file_content(configdir + "/dbserver"))
+	}
+
+	var dbuser string = "qbox"
+	if file_exists(configdir + "/dbuser") {
+		dbuser = chomp(file_content(configdir + "/dbuser"))
+	}
+
+	var dbpass string
+	if file_exists(configdir + "/dbpass") {
+		dbpass = chomp(file_content(configdir + "/dbpass"))
+	}
+
+	// Initialize DB
+	var err error
+	db, err = sql.Open("mysql", dbuser+":"+dbpass+"@tcp("+dbserver+")/qbox")
+	if err == nil {
+		err = db.Ping()
+		if err != nil {
+			fmt.Println("ERROR: MySQL db.Ping failed! [" + err.Error() + "]")
+			os.Exit(2)
+		}
+	} else {
+		fmt.Println("ERROR: Could not connect to MySQL [" + err.Error() + "]")
+		os.Exit(2)
+	}
+	defer db.Close()
+
+	user := os.Args[2]
+	if !user_exists(user) {
+		fmt.Println("ERROR: Unknown user " + user)
+		os.Exit(1)
+	}
+
+	switch {
+	case os.Args[1] == "list" && len(os.Args) == 3:
+		os.Exit(list_prefs(user))
+	case os.Args[1] == "set" && len(os.Args) == 5 && os.Args[3] == "required_score":
+		if _, err := strconv.ParseFloat(os.Args[4], 64); err != nil {
+			usage()
+		}
+		os.Exit(set_pref(user, "required_score", os.Args[4], ""))
+	case os.Args[1] == "set" && len(os.Args) == 6 && os.Args[3] == "score":
+		if _, err := strconv.ParseFloat(os.Args[5], 64); err != nil || !rulename.MatchString(os.Args[4]) {
+			usage()
+		}
+		// One line per rule, so an existing score for the rule is replaced
+		os.Exit(set_pref(user, "score", os.Args[4]+" "+os.Args[5], os.Args[4]))
+	case os.Args[1] == "add" && len(os.Args) == 5 && listprefs[os.Args[3]]:
+		if strings.ContainsAny(os.Args[4], " \t") || os.Args[4] == "" {
+			usage()
+		}
+		os.Exit(add_pref(user, os.Args[3], os.Args[4]))
+	case os.Args[1] == "del" && (len(os.Args) == 4 || len(os.Args) == 5):
+		value := ""
+		if len(os.Args) == 5 {
+			value = os.Args[4]
+		}
+		os.Exit(del_pref(user, os.Args[3], value))
+	}
+
+	usage()
+}
+
+func usage() {
+	fmt.Println("Usage: " + os.Args[0] + " list USER | set USER required_score SCORE | set USER score RULE SCORE |")
+	fmt.Println("       add USER whitelist_from|blacklist_from|welcomelist_from|blocklist_from ADDRESS | del USER PREFERENCE [VALUE]")
+	os.Exit(1)
+}
+
+func user_exists(user string) bool {
+	if user == "@GLOBAL" {
+		return true
+	}
+
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM passwd WHERE username = ?", user).Scan(&count)
+	if err != nil {
+		fmt.Println("ERROR: Could not read users [" + err.Error() + "]")
+		os.Exit(2)
+	}
+	return count > 0
+}
+
+func list_prefs(user string) int {
+	rows, err := db.Query("SELECT preference, value FROM userpref WHERE username = ? ORDER BY preference, value", user)
+	if err != nil {
+		fmt.Println("ERROR: Could not read preferences [" + err.Error() + "]")
+		return 2
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var preference, value string
+		if err := rows.Scan(&preference, &value); err != nil {
+			fmt.Println("ERROR: Could not read preferences [" + err.Error() + "]")
+			return 2
+		}
+		fmt.Printf("%s\t%s\n", preference, value)
+	}
+	return 0
+}
+
+func set_pref(user string, preference string, value string, match string) int {
+	// Replaces the old value, `match` limits that to values starting with
+	// that word (e.g. one rule's score). No LIKE, rule names contain `_`
+	tx, err := db.Begin()
+	if err == nil {
+		if match == "" {
+			_, err = tx.Exec("DELETE FROM userpref WHERE username = ? AND preference = ?", user, preference)
+		} else {
+			_, err = tx.Exec("DELETE FROM userpref WHERE username = ? AND preference = ? AND SUBSTRING_INDEX(value, ' ', 1) = ?", user, preference, match)
+		}
+		if err == nil {
+			_, err = tx.Exec("INSERT INTO userpref (username, preference, value) VALUES (?, ?, ?)", user, preference, value)
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	if err != nil {
+		fmt.Println("ERROR: Could not set " + preference + " [" + err.Error() + "]")
+		return 2
+	}
+
+	fmt.Println("Set " + preference + " " + value + " for " + user)
+	return 0
+}
+
+func add_pref(user string, preference string, value string) int {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM userpref WHERE username = ? AND preference = ? AND value = ?", user, preference, value).Scan(&count)
+	if err == nil && count == 0 {
+		_, err = db.Exec("INSERT INTO userpref (username, preference, value) VALUES (?, ?, ?)", user, preference, value)
+	}
+	if err != nil {
+		fmt.Println("ERROR: Could not add " + preference + " [" + err.Error() + "]")
+		return 2
+	}
+
+	fmt.Println("Added " + preference + " " + value + " for " + user)
+	return 0
+}
+
+func del_pref(user string, preference string, value string) int {
+	var result sql.Result
+	var err error
+	switch {
+	case value == "":
+		result, err = db.Exec("DELETE FROM userpref WHERE username = ? AND preference = ?", user, preference)
+	case preference == "score":
+		// Scores are stored as "RULE SCORE", the rule name is enough to delete one
+		result, err = db.Exec("DELETE FROM userpref WHERE username = ? AND preference = ? AND (value = ? OR SUBSTRING_INDEX(value, ' ', 1) = ?)", user, preference, value, value)
+	default:
+		result, err = db.Exec("DELETE FROM userpref WHERE username = ? AND preference = ? AND value = ?", user, preference, value)
+	}
+	if err != nil {
+		fmt.Println("ERROR: Could not delete " + preference + " [" + err.Error() + "]")
+		return 2
+	}
+
+	removed, _ := result.RowsAffected()
+	if removed == 0 {
+		fmt.Println("ERROR: No such preference for " + user)
+		return 1
+	}
+	fmt.Printf("Deleted %d %s entries for %s\n", removed, preference, user)
+	return 0
+}
+
+func file_exists(filename string) bool {
+	_, err := os.Stat(filename)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+func file_content(filename string) string {
+	buf, err := os.ReadFile(filename)
+	if err == nil {
+		return string(buf)
+	}
+	return ""
+}
+
+func chomp(s string) string {
+	return strings.TrimRight(s, "\n")
+}
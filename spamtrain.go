@@ -0,0 +1,470 @@
+package main
+
+import "bufio"
+import "bytes"
+import "context"
+import "database/sql"
+import _ "github.com/go-sql-driver/mysql"
+import "encoding/base64"
+import "errors"
+import "fmt"
+import "io"
+import "mime"
+import "mime/multipart"
+import "mime/quotedprintable"
+import "net"
+import "net/mail"
+import "os"
+import "path"
+import "path/filepath"
+import "regexp"
+import "sort"
+import "strconv"
+import "strings"
+import "time"
+
+import "github.com/teamwork/spamc"
+
+const configdir = "/etc/qbox"
+
+// spamd usually skips larger messages, so we don't send them
+const spamtrain_maxsize = 512000
+
+// Trains spamd's Bayes database via TELL (spamd needs --allow-tell)
+//
+// Without arguments, the spam folder (`spamdir`) and the ham folder
+// (`hamdir`, default `.NotSpam`) of every user with `antispam` enabled are
+// scanned. Messages that appeared since the last run are learned, learned
+// messages are recorded in `qbox-spamtrain` in the user's maildir.
+//
+// With `--report spam|ham`, spamtrain runs as a pipe destination, e.g. for a
+// report address of a domain, and learns every message attached to the
+// message on STDIN. Only reports sent with SMTP AUTH are accepted, they
+// train the Bayes database of the authenticated user.
+
+// Exit codes
+// 0 = success
+// 1 = usage error
+// 2 = database problem (maildir mode)
+// 100 = no attached messages found or reporter not authenticated (report mode)
+// 111 = temporary failure
+
+var db *sql.DB
+
+// A user whose folders are trained
+type trainee struct {
+	Uid      int
+	Username string
+	Maildir  string
+	Spam     string
+	Ham      string
+}
+
+func main() {
+	if len(os.Args) == 3 && os.Args[1] == "--report" &&
+		(os.Args[2] == "spam" || os.Args[2] == "ham") {
+		os.Exit(report_mode(os.Args[2]))
+	}
+	if len(os.Args) != 1 {
+		fmt.Println("Usage: " + os.Args[0] + " [--report spam|ham]")
+		os.Exit(1)
+	}
+
+	if err := open_database(); err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		os.Exit(2)
+	}
+	defer db.Close()
+
+	trainees, err := get_trainees()
+	if err != nil {
+		fmt.Println("ERROR: Could not read users [" + err.Error() + "]")
+		os.Exit(2)
+	}
+
+	exitcode := 0
+	for _, user := range trainees {
+		spam, ham, err := train_maildir(user)
+		fmt.Printf("uid %d: learned %d spam, %d ham\n", user.Uid, spam, ham)
+		if err != nil {
+			fmt.Printf("ERROR: Training failed for uid %d [%s]\n", user.Uid, err.Error())
+			exitcode = 111
+		}
+	}
+
+	os.Exit(exitcode)
+}
+
+func open_database() error {
+	// Read config files
+	var dbserver string = "127.0.0.1"
+	if file_exists(configdir + "/dbserver") {
+		dbserver = chomp(file_content(configdir + "/dbserver"))
+	}
+
+	var dbuser string = "qbox"
+	if file_exists(configdir + "/dbuser") {
+		dbuser = chomp(file_content(configdir + "/dbuser"))
+	}
+
+	var dbpass string
+	if file_exists(configdir + "/dbpass") {
+		dbpass = chomp(file_content(configdir + "/dbpass"))
+	}
+
+	// Initialize DB
+	var err error
+	db, err = sql.Open("mysql", dbuser+":"+dbpass+"@tcp("+dbserver+")/qbox")
+	if err != nil {
+		return errors.New("Could not connect to MySQL [" + err.Error() + "]")
+	}
+	if err = db.Ping(); err != nil {
+		return errors.New("MySQL db.Ping failed! [" + err.Error() + "]")
+	}
+	return nil
+}
+
+func get_trainees() ([]trainee, error) {
+	var result []trainee
+
+	hamdir := chomp(file_content(configdir + "/hamdir"))
+	if hamdir == "" {
+		hamdir = chomp(file_content(configdir+"/inbox")) + "/.NotSpam"
+	}
+
+	// Relative homedirs are pipes or forwards, which have no folders
+	rows, err := db.Query("SELECT uid, username, homedir, COALESCE(spamdir,'') FROM passwd WHERE antispam > 0 AND homedir LIKE '/%'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var uid int
+		var username, homedir, spamdir string
+		err := rows.Scan(&uid, &username, &homedir, &spamdir)
+		if err != nil {
+			return nil, err
+		}
+
+		// Same rules as in `deliver`, folders are relative to `homedir`
+		user := trainee{Uid: uid, Username: username, Maildir: path.Clean(homedir + "/" + chomp(file_content(configdir+"/inbox")))}
+		if spamdir != "" {
+			user.Spam = path.Clean(homedir + "/" + spamdir)
+		}
+		user.Ham = path.Clean(homedir + "/" + hamdir)
+		result = append(result, user)
+	}
+
+	return result, rows.Err()
+}
+
+func train_maildir(user trainee) (int, int, error) {
+	statefile := user.Maildir + "/qbox-spamtrain"
+	learned := read_state(statefile)
+	seen := make(map[string]bool)
+	count := map[string]int{}
+
+	var trainerr error
+	for _, folder := range []struct{ class, directory string }{{"spam", user.Spam}, {"ham", user.Ham}} {
+		// Without a spam folder, spam ends up in INBOX and can't be told apart
+		if folder.directory == "" || folder.directory == user.Maildir {
+			continue
+		}
+		for _, file := range maildir_messages(folder.directory) {
+			key := folder.class + " " + maildir_unique(file)
+			seen[key] = true
+			if learned[key] {
+				continue
+			}
+
+			err := tell_file(file, folder.class, user.Username)
+			if err != nil {
+				// Not recorded, so the next run tries again
+				trainerr = err
+				delete(seen, key)
+				continue
+			}
+			count[folder.class]++
+		}
+	}
+
+	// Only keep messages which still exist, so the state doesn't grow forever
+	if err := write_state(statefile, seen); err != nil && trainerr == nil {
+		trainerr = err
+	}
+
+	return count["spam"], count["ham"], trainerr
+}
+
+func maildir_messages(directory string) []string {
+	var result []string
+	for _, subdir := range []string{"/cur", "/new"} {
+		files, err := os.ReadDir(directory + subdir)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if file.Type().IsRegular() && !strings.HasPrefix(file.Name(), ".") {
+				result = append(result, directory+subdir+"/"+file.Name())
+			}
+		}
+	}
+	return result
+}
+
+func maildir_unique(filename string) string {
+	// The part after the colon holds flags, which change over time
+	return strings.SplitN(filepath.Base(filename), ":", 2)[0]
+}
+
+func read_state(statefile string) map[string]bool {
+	result := make(map[string]bool)
+
+	file, err := os.Open(statefile)
+	if err != nil {
+		return result
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			result[line] = true
+		}
+	}
+	return result
+}
+
+func write_state(statefile string, learned map[string]bool) error {
+	var lines []string
+	for key := range learned {
+		lines = append(lines, key+"\n")
+	}
+	sort.Strings(lines)
+
+	// Written to a temporary file first, so a crash doesn't lose the state
+	err := os.WriteFile(statefile+".tmp", []byte(strings.Join(lines, "")), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(statefile+".tmp", statefile)
+}
+
+func tell_file(filename string, class string, username string) error {
+	input, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	info, err := input.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > spamtrain_maxsize {
+		return nil
+	}
+
+	return spamd_tell(input, class, username)
+}
+
+func spamd_tell(input io.Reader, class string, username string) (err error) {
+	var spamd_url string = "127.0.0.1:783"
+	// read config file
+	if file_exists(configdir + "/spamd") {
+		spamd_url = chomp(file_content(configdir + "/spamd"))
+	}
+
+	// spamc panics instead of returning an error if spamd can't be reached
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("could not talk to spamd at %s", spamd_url)
+		}
+	}()
+
+	// Same user as `deliver` passes, so spamd learns into the user's own Bayes database
+	header := spamc.Header{}.
+		Set("Message-class", class).
+		Set("Set", "local")
+	if username != "" {
+		header = header.Set("User", username)
+	}
+
+	client := spamc.New(spamd_url, &net.Dialer{Timeout: 2 * time.Second})
+	_, err = client.Tell(context.Background(), input, header)
+	return err
+}
+
+func report_mode(class string) int {
+	message, err := mail.ReadMessage(os.Stdin)
+	if err != nil {
+		fmt.Println("ERROR: Could not parse message [" + err.Error() + "]")
+		return 100
+	}
+
+	// The envelope sender can be forged, so the reporter is the user who
+	// authenticated when the report was submitted
+	identity := smtp_auth_identity(message.Header)
+	if identity == "" {
+		fmt.Println("Reports are only accepted from authenticated users")
+		return 100
+	}
+
+	if err := open_database(); err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		return 111
+	}
+	defer db.Close()
+
+	username, err := reporter_username(identity)
+	if err != nil {
+		fmt.Println("ERROR: Could not read users [" + err.Error() + "]")
+		return 111
+	}
+	if username == "" {
+		fmt.Println("Reports are not accepted from " + identity)
+		return 100
+	}
+
+	attached, err := attached_messages(message.Header, message.Body)
+	if err != nil {
+		fmt.Println("ERROR: Could not parse message [" + err.Error() + "]")
+		return 100
+	}
+	if len(attached) == 0 {
+		fmt.Println("No attached messages found, please forward messages as attachment")
+		return 100
+	}
+
+	for _, part := range attached {
+		if len(part) > spamtrain_maxsize {
+			continue
+		}
+		// Same database `deliver` scans the reporter's messages with
+		err := spamd_tell(bytes.NewReader(part), class, username)
+		if err != nil {
+			fmt.Println("ERROR: Could not learn message [" + err.Error() + "]")
+			return 111
+		}
+	}
+
+	fmt.Printf("Learned %d message(s) as %s for %s\n", len(attached), class, username)
+	return 0
+}
+
+func attached_messages(header map[string][]string, body io.Reader) ([][]byte, error) {
+	var result [][]byte
+
+	mediatype, params, err := mime.ParseMediaType(first(header["Content-Type"]))
+	if err != nil {
+		// Messages without Content-Type are text/plain
+		return nil, nil
+	}
+
+	if strings.HasPrefix(mediatype, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			nested, err := attached_messages(part.Header, part)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, nested...)
+		}
+		return result, nil
+	}
+
+	if mediatype == "message/rfc822" {
+		content, err := io.ReadAll(transfer_decoder(first(header["Content-Transfer-Encoding"]), body))
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{content}, nil
+	}
+
+	return nil, nil
+}
+
+func transfer_decoder(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func smtp_auth_identity(header mail.Header) string {
+	// qmail-smtpd with SMTP AUTH writes: from HOST (HELO NAME) (USER@IP) by HOST with ESMTPA
+	// qmail-queue's own lines (qmail PID invoked ...) come first, the next
+	// one is ours. `trusted_hops` skips the ones our own relays added
+	identityre := regexp.MustCompile(`\(([^()\s]+)@[0-9a-fA-F:.]+\)`)
+	authre := regexp.MustCompile(`\bwith\s+E?SMTPS?A\b`)
+
+	var received []string
+	for _, value := range header["Received"] {
+		if !strings.HasPrefix(strings.TrimSpace(value), "(qmail ") {
+			received = append(received, value)
+		}
+	}
+
+	hops := trusted_hops()
+	if len(received) <= hops || !authre.MatchString(received[hops]) {
+		return ""
+	}
+	if match := identityre.FindStringSubmatch(received[hops]); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+func trusted_hops() int {
+	// Same setting as in `deliver`
+	hops, err := strconv.Atoi(chomp(file_content(configdir + "/trusted_hops")))
+	if err != nil || hops < 0 {
+		return 0
+	}
+	return hops
+}
+
+func reporter_username(identity string) (string, error) {
+	// SMTP AUTH uses `passwd.username`, which is also spamd's user
+	var username string
+	err := db.QueryRow("SELECT username FROM passwd WHERE username = ? AND locked = 0", identity).Scan(&username)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return username, err
+}
+
+func file_exists(filename string) bool {
+	_, err := os.Stat(filename)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+func file_content(filename string) string {
+	buf, err := os.ReadFile(filename)
+	if err == nil {
+		return string(buf)
+	}
+	return ""
+}
+
+func chomp(s string) string {
+	return strings.TrimRight(s, "\n")
+}
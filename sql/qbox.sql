@@ -23,6 +23,24 @@ CREATE DATABASE /*!32312 IF NOT EXISTS*/ `qbox` /*!40100 DEFAULT CHARACTER SET u
 
 USE `qbox`;
 
+--
+-- Table structure for table `attachpolicy`
+--
+
+DROP TABLE IF EXISTS `attachpolicy`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `attachpolicy` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `domain` varchar(255) NOT NULL DEFAULT '*',
+  `kind` varchar(16) NOT NULL DEFAULT 'extension',
+  `value` varchar(255) NOT NULL DEFAULT '',
+  `action` varchar(16) NOT NULL DEFAULT 'block',
+  PRIMARY KEY (`id`),
+  KEY `domain` (`domain`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `autoconfig`
 --
@@ -71,6 +89,7 @@ CREATE TABLE `domains` (
   `rewrite` varchar(255) DEFAULT NULL,
   `uid` bigint(20) DEFAULT NULL,
   `status` tinyint(4) DEFAULT NULL,
+  `scanfail` varchar(16) DEFAULT NULL,
   PRIMARY KEY (`domain`),
   UNIQUE KEY `domain` (`domain`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -109,6 +128,35 @@ CREATE TABLE `filters` (
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Dumping data for table `filters`
+--
+
+LOCK TABLES `filters` WRITE;
+/*!40000 ALTER TABLE `filters` DISABLE KEYS */;
+INSERT INTO `filters` VALUES (1,'Sender contains','SENDER contains'),(2,'From contains','From contains'),(3,'To contains','To contains'),(4,'Cc contains','Cc contains'),(5,'Subject contains','Subject contains'),(6,'Subject begins with','Subject begins'),(7,'Subject matches regular expression','Subject matches'),(8,'List-Id is','List-Id is'),(9,'Is a mailing list','List-Id exists'),(10,'Recipient is','RECIPIENT is');
+/*!40000 ALTER TABLE `filters` ENABLE KEYS */;
+UNLOCK TABLES;
+
+--
+-- Table structure for table `journal`
+--
+
+DROP TABLE IF EXISTS `journal`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `journal` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `sha1` char(40) NOT NULL DEFAULT '',
+  `rcpt` varchar(255) NOT NULL DEFAULT '',
+  `destination` varchar(255) NOT NULL DEFAULT '',
+  `time` bigint(11) NOT NULL DEFAULT '0',
+  PRIMARY KEY (`id`),
+  KEY `message` (`sha1`,`rcpt`),
+  KEY `time` (`time`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `lastlogin`
 --
@@ -159,6 +207,7 @@ CREATE TABLE `passwd` (
   `homedir` varchar(255) NOT NULL DEFAULT '',
   `spamdir` varchar(255) DEFAULT NULL,
   `spamlimit` int(3) DEFAULT NULL,
+  `spamtag` varchar(32) DEFAULT NULL,
   `sysuid` int(11) NOT NULL DEFAULT '8',
   `sysgid` int(11) NOT NULL DEFAULT '8',
   `quota` bigint(20) NOT NULL DEFAULT '0',
@@ -169,16 +218,21 @@ CREATE TABLE `passwd` (
   `imaps` char(3) NOT NULL DEFAULT 'yes',
   `extmail` varchar(320) NOT NULL DEFAULT '',
   `antivir` int(11) NOT NULL DEFAULT '0',
+  `attachfilter` tinyint(4) NOT NULL DEFAULT '0',
   `antispam` int(11) NOT NULL DEFAULT '0',
   `arstart` bigint(20) NOT NULL DEFAULT '0',
   `arend` bigint(20) NOT NULL DEFAULT '0',
   `artext` text,
+  `arinterval` bigint(20) NOT NULL DEFAULT '604800',
+  `autoresponder` tinyint(4) NOT NULL DEFAULT '0',
   `prquestion` varchar(255) NOT NULL DEFAULT '',
   `pranswer` varchar(64) NOT NULL DEFAULT '',
   `open` bigint(20) NOT NULL DEFAULT '0',
   `close` bigint(20) NOT NULL DEFAULT '0',
   `locked` tinyint(4) NOT NULL DEFAULT '0',
   `dupfilter` tinyint(4) NOT NULL DEFAULT '0',
+  `dmarcreject` tinyint(4) NOT NULL DEFAULT '0',
+  `extensions` tinyint(4) NOT NULL DEFAULT '1',
   `oath_token` varchar(64) NOT NULL,
   `email_as_login` char(3) NOT NULL DEFAULT '',
   `alias_of` char(64) NOT NULL DEFAULT '',
@@ -215,6 +269,23 @@ CREATE TABLE `sendlog` (
   `size` bigint(4) NOT NULL
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `userpref`
+--
+
+DROP TABLE IF EXISTS `userpref`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `userpref` (
+  `username` varchar(100) NOT NULL DEFAULT '',
+  `preference` varchar(50) NOT NULL DEFAULT '',
+  `value` varchar(100) NOT NULL DEFAULT '',
+  `prefid` int(11) NOT NULL AUTO_INCREMENT,
+  PRIMARY KEY (`prefid`),
+  KEY `username` (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
 /*!40103 SET TIME_ZONE=@OLD_TIME_ZONE */;
 
 /*!40101 SET SQL_MODE=@OLD_SQL_MODE */;
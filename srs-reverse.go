@@ -0,0 +1,183 @@
+package main
+
+import "crypto/hmac"
+import "crypto/sha1"
+import "encoding/base64"
+import "errors"
+import "fmt"
+import "os"
+import "os/exec"
+import "strconv"
+import "strings"
+import "time"
+
+const configdir = "/etc/qbox"
+
+// Reverses SRS addresses created by `deliver` when forwarding mail
+//
+// As a qmail-spp plugin (SMTPRCPTTO is set), invalid or expired SRS
+// addresses in our SRS domain are rejected at RCPT time.
+//
+// As a pipe destination (RECIPIENT is set), e.g. for a `*` mapping of the
+// SRS domain, the bounce on STDIN is sent on to the original sender.
+
+// Exit codes (pipe mode)
+// 0 = bounce was passed on
+// 100 = not a valid SRS address
+// 111 = temporary failure
+
+func main() {
+	secret := chomp(file_content(configdir + "/srs_secret"))
+
+	if env_defined("SMTPRCPTTO") {
+		spp_check(os.Getenv("SMTPRCPTTO"), secret)
+		os.Exit(0)
+	}
+
+	if !env_defined("RECIPIENT") {
+		fmt.Println("RECIPIENT not set!")
+		os.Exit(111)
+	}
+
+	if secret == "" {
+		fmt.Println("ERROR: No SRS secret configured")
+		os.Exit(111)
+	}
+
+	recipient := strings.TrimPrefix(os.Getenv("RECIPIENT"), chomp(file_content(configdir+"/prefix")))
+	original, err := srs_reverse(recipient, secret, srs_maxage(), time.Now())
+	if err != nil {
+		fmt.Println("ERROR: Could not reverse " + recipient + " [" + err.Error() + "]")
+		os.Exit(100)
+	}
+
+	// Bounces are passed on with a null envelope sender
+	cmd := exec.Command("/var/qmail/bin/qmail-inject", "-f", "", original)
+	cmd.Stdin = os.Stdin
+	err = cmd.Run()
+	if err != nil {
+		fmt.Println("ERROR: Could not pass bounce for " + recipient + " to " + original + " [" + err.Error() + "]")
+		os.Exit(111)
+	}
+
+	fmt.Println("Bounce for " + recipient + " passed to " + original)
+	os.Exit(0)
+}
+
+func spp_check(smtprcptto string, secret string) {
+	at := strings.LastIndex(smtprcptto, "@")
+	if at < 1 ||
+		secret == "" ||
+		!strings.EqualFold(smtprcptto[at+1:], chomp(file_content(configdir+"/srs_domain"))) ||
+		!(srs_hastag(smtprcptto[:at], "SRS0") || srs_hastag(smtprcptto[:at], "SRS1")) {
+		fmt.Println()
+		return
+	}
+
+	_, err := srs_reverse(smtprcptto, secret, srs_maxage(), time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%d Rejecting SRS address %s (%s)\n", os.Getppid(), smtprcptto, err.Error())
+		fmt.Println("E553 Invalid SRS address")
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "%d Valid SRS address %s\n", os.Getppid(), smtprcptto)
+	fmt.Println()
+}
+
+func srs_reverse(address string, secret string, maxage int, now time.Time) (string, error) {
+	at := strings.LastIndex(address, "@")
+	if at < 1 {
+		return "", errors.New("no domain part")
+	}
+	local := address[:at]
+
+	// SRS0=HHHH=TT=domain=local -> local@domain
+	if srs_hastag(local, "SRS0") {
+		parts := strings.SplitN(local[5:], "=", 4)
+		if len(parts) != 4 {
+			return "", errors.New("malformed SRS0 address")
+		}
+		hash, timestamp, host, user := parts[0], parts[1], parts[2], parts[3]
+		if !strings.EqualFold(hash, srs_hash(secret, timestamp, host, user)) {
+			return "", errors.New("hash mismatch")
+		}
+		if !srs_timestamp_valid(timestamp, maxage, now) {
+			return "", errors.New("address expired")
+		}
+		return user + "@" + host, nil
+	}
+
+	// SRS1=HHHH=srshost==HHHH=TT=domain=local -> SRS0=HHHH=TT=domain=local@srshost
+	if srs_hastag(local, "SRS1") {
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) != 3 {
+			return "", errors.New("malformed SRS1 address")
+		}
+		hash, srshost, opaque := parts[0], parts[1], parts[2]
+		if !strings.EqualFold(hash, srs_hash(secret, srshost, opaque)) {
+			return "", errors.New("hash mismatch")
+		}
+		return "SRS0" + opaque + "@" + srshost, nil
+	}
+
+	return "", errors.New("not an SRS address")
+}
+
+func srs_hastag(local string, tag string) bool {
+	return len(local) > 5 &&
+		strings.EqualFold(local[:4], tag) &&
+		strings.ContainsAny(local[4:5], "=+-")
+}
+
+func srs_hash(secret string, data ...string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	for _, item := range data {
+		mac.Write([]byte(strings.ToLower(item)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:4]
+}
+
+func srs_timestamp_valid(timestamp string, maxage int, now time.Time) bool {
+	const base32 = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	if len(timestamp) != 2 {
+		return false
+	}
+
+	high := strings.IndexByte(base32, strings.ToUpper(timestamp)[0])
+	low := strings.IndexByte(base32, strings.ToUpper(timestamp)[1])
+	if high < 0 || low < 0 {
+		return false
+	}
+
+	// Timestamps wrap around every 1024 days
+	today := int((now.Unix() / 86400) % 1024)
+	age := (today - (high<<5 | low) + 1024) % 1024
+	return age <= maxage
+}
+
+func srs_maxage() int {
+	// Days an SRS address stays valid
+	maxage, err := strconv.Atoi(chomp(file_content(configdir + "/srs_maxage")))
+	if err != nil || maxage <= 0 {
+		return 21
+	}
+	return maxage
+}
+
+func env_defined(key string) bool {
+	_, exists := os.LookupEnv(key)
+	return exists
+}
+
+func file_content(filename string) string {
+	buf, err := os.ReadFile(filename)
+	if err == nil {
+		return string(buf)
+	}
+	return ""
+}
+
+func chomp(s string) string {
+	return strings.TrimRight(s, "\n")
+}